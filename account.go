@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/database"
+)
+
+const purgeInterval = 10 * time.Minute
+
+// deleteUser deletes the caller's account, and with it their chirps and
+// sessions, once they confirm their password. If ACCOUNT_DELETION_GRACE is
+// set the account is instead signed out everywhere and only deleted after
+// the grace period; logging in before then cancels the deletion.
+func (cfg *apiConfig) deleteUser(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if !cfg.verifyCurrentPassword(w, req, user, rb.Password) {
+		return
+	}
+
+	if cfg.deletionGrace <= 0 {
+		if err := cfg.db.DeleteUser(req.Context(), user.ID); err != nil {
+			respondWithError(w, req, http.StatusInternalServerError, "Error deleting account", err)
+			return
+		}
+		if usesCookieSession(req) {
+			clearSessionCookies(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		slog.InfoContext(req.Context(), "account deleted")
+		return
+	}
+
+	err = cfg.withTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		user, err = q.ScheduleUserDeletion(req.Context(), database.ScheduleUserDeletionParams{
+			ID:          user.ID,
+			DeleteAfter: sql.NullTime{Time: time.Now().UTC().Add(cfg.deletionGrace), Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+		if err := q.RevokeUserAPIKeys(req.Context(), user.ID); err != nil {
+			return err
+		}
+		return q.RevokeUserSessions(req.Context(), user.ID)
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error scheduling account deletion", err)
+		return
+	}
+	if usesCookieSession(req) {
+		clearSessionCookies(w)
+	}
+	respondWithJSON(w, http.StatusAccepted, struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}{
+		DeleteAfter: user.DeleteAfter.Time,
+	})
+	slog.InfoContext(req.Context(), "account deletion scheduled", "delete_after", user.DeleteAfter.Time)
+}
+
+// cancelAccountDeletion keeps an account that was scheduled for deletion.
+func (cfg *apiConfig) cancelAccountDeletion(ctx context.Context, user database.User) {
+	if !user.DeleteAfter.Valid {
+		return
+	}
+	if err := cfg.db.CancelUserDeletion(ctx, user.ID); err != nil {
+		slog.ErrorContext(ctx, "error cancelling account deletion", "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "account deletion cancelled")
+}
+
+// purgeExpired deletes accounts whose grace period is over and refresh
+// tokens that are no longer needed, until ctx is done.
+func (cfg *apiConfig) purgeExpired(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now().UTC()
+		n, err := cfg.db.PurgeDeletedUsers(ctx, now)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "error purging deleted accounts", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "deleted accounts purged", "count", n)
+		}
+		n, err = cfg.db.DeleteStaleRefreshTokens(ctx, database.DeleteStaleRefreshTokensParams{
+			Now:           now,
+			RotatedBefore: now.Add(-rotatedRefreshTokenRetention),
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "error purging stale refresh tokens", "error", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "stale refresh tokens purged", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// accountExport is everything chirpy stores about a user that is theirs to
+// take away. Password hashes, TOTP secrets and token hashes are left out.
+type accountExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	Profile    struct {
+		User
+		TwoFactorEnabled bool       `json:"two_factor_enabled"`
+		DeleteAfter      *time.Time `json:"delete_after,omitempty"`
+	} `json:"profile"`
+	Chirps   []Chirp   `json:"chirps"`
+	Sessions []Session `json:"sessions"`
+}
+
+// exportUser sends the caller their data: a ZIP archive with one JSON file
+// per kind of data, or with ?format=json a single JSON document.
+func (cfg *apiConfig) exportUser(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "zip" && format != "json" {
+		respondWithError(w, req, http.StatusBadRequest, "Unknown export format", nil)
+		return
+	}
+
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	chirps, err := cfg.db.GetChirpsByUser(req.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error getting chirps", err)
+		return
+	}
+	sessions, err := cfg.db.ListSessions(req.Context(), database.ListSessionsParams{
+		UserID: user.ID,
+		Now:    time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error listing sessions", err)
+		return
+	}
+
+	export := accountExport{
+		ExportedAt: time.Now().UTC(),
+		Chirps:     make([]Chirp, 0, len(chirps)),
+		Sessions:   sessionsFromRows(sessions),
+	}
+	export.Profile.User = userResponse(user)
+	export.Profile.TwoFactorEnabled = user.TotpEnabled
+	if user.DeleteAfter.Valid {
+		export.Profile.DeleteAfter = &user.DeleteAfter.Time
+	}
+	for _, chirp := range chirps {
+		export.Chirps = append(export.Chirps, Chirp{
+			ID:        chirp.ID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body:      chirp.Body,
+			UserID:    chirp.UserID,
+			Author:    authorOf(user),
+		})
+	}
+
+	filename := "chirpy-export-" + export.ExportedAt.Format("20060102")
+	if format == "json" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		respondWithJSON(w, http.StatusOK, export)
+		slog.InfoContext(req.Context(), "account data exported", "format", "json")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	w.WriteHeader(http.StatusOK)
+	// The status is already sent, so from here on errors can only be logged;
+	// the client is left with a truncated archive it can't open.
+	zw := zip.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.Profile},
+		{"chirps.json", export.Chirps},
+		{"sessions.json", export.Sessions},
+	} {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			slog.ErrorContext(req.Context(), "error writing export", "error", err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			slog.ErrorContext(req.Context(), "error writing export", "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(req.Context(), "error writing export", "error", err)
+		return
+	}
+	slog.InfoContext(req.Context(), "account data exported", "format", "zip")
+}
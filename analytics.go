@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/analytics"
+	"github.com/0x4D5352/chirpy/internal/database"
+)
+
+// middlewareMetricsInc counts a view of the static app. Successful responses
+// are also queued for the persistent per-page analytics; this never blocks
+// the request.
+func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		cfg.fileServerHits.Add(1)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		// Only count pages that were served, including revisits answered
+		// with 304 from the browser's cache: 404 probes would fill the table
+		// with junk paths, and a redirect is counted again at its target.
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if (status >= 200 && status < 300) || status == http.StatusNotModified {
+			cfg.pageHits.Record(pagePath(req.URL.Path), time.Now().UTC())
+		}
+	}
+	return http.HandlerFunc(handler)
+}
+
+// pagePath normalizes a request path so "/app/" and "/app/index.html" are
+// counted as the same page.
+func pagePath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") {
+		clean = path.Join(clean, "index.html")
+	}
+	return clean
+}
+
+func (cfg *apiConfig) flushPageHits(ctx context.Context, hits []analytics.Hit) error {
+	params := database.InsertPageHitsParams{
+		Paths:  make([]string, len(hits)),
+		HitAts: make([]time.Time, len(hits)),
+	}
+	for i, hit := range hits {
+		params.Paths[i] = hit.Path
+		params.HitAts[i] = hit.At
+	}
+	return cfg.db.InsertPageHits(ctx, params)
+}
+
+type pageHits struct {
+	Path string `json:"path"`
+	Hits int64  `json:"hits"`
+}
+
+type dailyHits struct {
+	Date  string     `json:"date"`
+	Pages []pageHits `json:"pages"`
+}
+
+type metricsReport struct {
+	Visits int32       `json:"visits_since_start"`
+	Days   int         `json:"days"`
+	Pages  []pageHits  `json:"pages"`
+	Daily  []dailyHits `json:"daily"`
+}
+
+var metricsTemplate = template.Must(template.New("metrics").Parse(`<html>
+  <body>
+    <h1>Welcome, Chirpy Admin</h1>
+    <p>Chirpy has been visited {{.Visits}} times!</p>
+    <h2>All-time page views</h2>
+    <table>
+      <tr><th>Page</th><th>Views</th></tr>
+      {{- range .Pages}}
+      <tr><td>{{.Path}}</td><td>{{.Hits}}</td></tr>
+      {{- end}}
+    </table>
+    <h2>Last {{.Days}} days</h2>
+    <table>
+      <tr><th>Date</th><th>Page</th><th>Views</th></tr>
+      {{- range $day := .Daily}}{{range $day.Pages}}
+      <tr><td>{{$day.Date}}</td><td>{{.Path}}</td><td>{{.Hits}}</td></tr>
+      {{- end}}{{end}}
+    </table>
+  </body>
+</html>`))
+
+// checkMetrics reports page views as HTML, or as JSON when asked for with
+// ?format=json or an Accept header. ?days= picks how many daily buckets to
+// include, up to 90.
+func (cfg *apiConfig) checkMetrics(w http.ResponseWriter, req *http.Request) {
+	days := 7
+	if raw := req.URL.Query().Get("days"); raw != "" {
+		d, err := strconv.Atoi(raw)
+		if err != nil || d < 1 || d > 90 {
+			respondWithError(w, req, http.StatusBadRequest, "days must be between 1 and 90", nil)
+			return
+		}
+		days = d
+	}
+
+	report := metricsReport{
+		Visits: cfg.fileServerHits.Load(),
+		Days:   days,
+		Pages:  []pageHits{},
+		Daily:  []dailyHits{},
+	}
+
+	totals, err := cfg.db.GetPageHitTotals(req.Context())
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error getting page hits", err)
+		return
+	}
+	for _, row := range totals {
+		report.Pages = append(report.Pages, pageHits{Path: row.Path, Hits: row.Hits})
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -(days - 1))
+	daily, err := cfg.db.GetDailyPageHits(req.Context(), since)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error getting daily page hits", err)
+		return
+	}
+	for _, row := range daily {
+		date := row.Day.Format(time.DateOnly)
+		if n := len(report.Daily); n == 0 || report.Daily[n-1].Date != date {
+			report.Daily = append(report.Daily, dailyHits{Date: date})
+		}
+		last := &report.Daily[len(report.Daily)-1]
+		last.Pages = append(last.Pages, pageHits{Path: row.Path, Hits: row.Hits})
+	}
+
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+
+	var body strings.Builder
+	if err := metricsTemplate.Execute(&body, report); err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error rendering metrics", err)
+		return
+	}
+	respondWithText(w, http.StatusOK, "text/html; charset=utf-8", body.String())
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// API keys let bots and integrations act for a user without their password.
+// They go in the Authorization header like access tokens, but only
+// handlers that authenticate with authenticateScoped accept them, and only
+// for the scopes they were granted.
+
+const maxAPIKeyNameLength = 100
+
+var (
+	errAPIKeyNotAccepted = errors.New("API keys are not accepted here")
+	errMissingScope      = errors.New("credentials lack the required scope")
+	errInvalidAPIKey     = errors.New("invalid API key")
+	errAPIKeyRevoked     = errors.New("API key has been revoked")
+	errAPIKeyExpired     = errors.New("API key has expired")
+)
+
+// APIKey is an API key as its owner sees it. Key is only ever filled in
+// when the key is created.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func apiKeyResponse(key database.ApiKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: nullTimePtr(key.LastUsedAt),
+		ExpiresAt:  nullTimePtr(key.ExpiresAt),
+	}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// checkAPIKey returns the stored key matching a raw API key, as long as it
+// is still usable.
+func (cfg *apiConfig) checkAPIKey(ctx context.Context, raw string) (database.ApiKey, error) {
+	prefix, ok := auth.ParseAPIKey(raw)
+	if !ok {
+		return database.ApiKey{}, errInvalidAPIKey
+	}
+	key, err := cfg.db.GetAPIKeyByPrefix(ctx, prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.ApiKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return database.ApiKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashAPIKey(raw)), []byte(key.KeyHash)) != 1 {
+		return database.ApiKey{}, errInvalidAPIKey
+	}
+	if key.RevokedAt.Valid {
+		return database.ApiKey{}, errAPIKeyRevoked
+	}
+	if key.ExpiresAt.Valid && !time.Now().UTC().Before(key.ExpiresAt.Time) {
+		return database.ApiKey{}, errAPIKeyExpired
+	}
+	return key, nil
+}
+
+// authenticateAPIKey is the API key half of authenticateScoped.
+func (cfg *apiConfig) authenticateAPIKey(ctx context.Context, raw, scope string) (auth.Claims, error) {
+	if scope == "" {
+		return auth.Claims{}, errAPIKeyNotAccepted
+	}
+	key, err := cfg.checkAPIKey(ctx, raw)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if !slices.Contains(key.Scopes, scope) {
+		return auth.Claims{}, errMissingScope
+	}
+	if err := cfg.db.TouchAPIKey(ctx, key.ID); err != nil {
+		slog.WarnContext(ctx, "error recording API key use", "error", err)
+	}
+	setRequestUserID(ctx, key.UserID)
+	return auth.Claims{UserID: key.UserID}, nil
+}
+
+func (cfg *apiConfig) createAPIKey(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	if rb.Name == "" || len(rb.Name) > maxAPIKeyNameLength {
+		respondWithError(w, req, http.StatusBadRequest, "Name must be 1 to 100 characters", nil)
+		return
+	}
+	if len(rb.Scopes) == 0 {
+		respondWithError(w, req, http.StatusBadRequest, "At least one scope is required", nil)
+		return
+	}
+	for _, scope := range rb.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, req, http.StatusBadRequest, "Unknown scope "+scope, nil)
+			return
+		}
+	}
+	slices.Sort(rb.Scopes)
+	rb.Scopes = slices.Compact(rb.Scopes)
+	var expiresAt sql.NullTime
+	if rb.ExpiresAt != nil {
+		if !rb.ExpiresAt.After(time.Now()) {
+			respondWithError(w, req, http.StatusBadRequest, "Expiry must be in the future", nil)
+			return
+		}
+		expiresAt = sql.NullTime{Time: rb.ExpiresAt.UTC(), Valid: true}
+	}
+
+	raw, prefix, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error generating API key", err)
+		return
+	}
+	key, err := cfg.db.CreateAPIKey(req.Context(), database.CreateAPIKeyParams{
+		UserID:    claims.UserID,
+		Name:      rb.Name,
+		Prefix:    prefix,
+		KeyHash:   auth.HashAPIKey(raw),
+		Scopes:    rb.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error creating API key", err)
+		return
+	}
+	body := apiKeyResponse(key)
+	body.Key = raw
+	respondWithJSON(w, http.StatusCreated, body)
+	slog.InfoContext(req.Context(), "API key created", "key_prefix", key.Prefix, "scopes", key.Scopes)
+}
+
+func (cfg *apiConfig) listAPIKeys(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	keys, err := cfg.db.ListAPIKeys(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error listing API keys", err)
+		return
+	}
+	body := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		body = append(body, apiKeyResponse(key))
+	}
+	respondWithJSON(w, http.StatusOK, body)
+}
+
+func (cfg *apiConfig) revokeAPIKey(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	keyID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid API key ID", err)
+		return
+	}
+	n, err := cfg.db.RevokeAPIKey(req.Context(), database.RevokeAPIKeyParams{
+		ID:     keyID,
+		UserID: claims.UserID,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error revoking API key", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, req, http.StatusNotFound, "API key not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "API key revoked", "key_id", keyID)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/0x4D5352/chirpy/internal/database"
+)
+
+const usage = `usage: chirpy [command]
+
+With no command, chirpy runs the server. Commands:
+
+  grant-admin EMAIL      give the user with EMAIL the admin role
+  set-role EMAIL ROLE    set the role of the user with EMAIL to user, moderator or admin
+`
+
+// runCommand runs a maintenance command instead of the server and returns
+// the process's exit status.
+func runCommand(ctx context.Context, db *database.Queries, args []string, stdout, stderr io.Writer) int {
+	switch {
+	case args[0] == "grant-admin" && len(args) == 2:
+		return setRole(ctx, db, args[1], roleAdmin, stdout, stderr)
+	case args[0] == "set-role" && len(args) == 3:
+		return setRole(ctx, db, args[1], args[2], stdout, stderr)
+	default:
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+}
+
+func setRole(ctx context.Context, db *database.Queries, email, role string, stdout, stderr io.Writer) int {
+	if _, ok := roleRank[role]; !ok {
+		fmt.Fprintf(stderr, "unknown role %q\n", role)
+		return 2
+	}
+	n, err := db.SetUserRoleByEmail(ctx, database.SetUserRoleByEmailParams{
+		Email: email,
+		Role:  role,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "error setting role: %v\n", err)
+		return 1
+	}
+	if n == 0 {
+		fmt.Fprintf(stderr, "no user with email %q\n", email)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s is now %s\n", email, role)
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a duration such as "5s" or "1m30s" from the environment,
+// falling back to the default when the variable is unset or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		slog.Warn("invalid duration in environment, using default", "key", key, "value", raw, "default", fallback, "error", err)
+		return fallback
+	}
+	return d
+}
+
+// envString reads a string from the environment, falling back to the default
+// when the variable is unset.
+func envString(key, fallback string) string {
+	if raw := os.Getenv(key); raw != "" {
+		return raw
+	}
+	return fallback
+}
+
+// envInt reads an integer from the environment, falling back to the default
+// when the variable is unset or invalid.
+func envInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		slog.Warn("invalid integer in environment, using default", "key", key, "value", raw, "default", fallback, "error", err)
+		return fallback
+	}
+	return n
+}
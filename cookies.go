@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+)
+
+// Browser clients can log in with "cookie_session": true to have their
+// tokens kept in HttpOnly cookies instead of handing them to JavaScript.
+// Because the browser attaches those cookies to any request, state-changing
+// routes also require the X-CSRF-Token header to echo the readable
+// csrf_token cookie (the double-submit pattern): a cross-site page can make
+// the browser send the cookies but cannot read one to copy it into a header.
+const (
+	refreshTokenCookie = "refresh_token"
+	csrfCookie         = "csrf_token"
+	csrfHeader         = "X-CSRF-Token"
+
+	// refreshTokenTTL is how long a login lasts. Refreshing hands out new
+	// tokens but doesn't extend it.
+	refreshTokenTTL = 60 * 24 * time.Hour
+
+	// rotatedRefreshTokenRetention is how long a used refresh token is kept
+	// so that replaying it still revokes its family.
+	rotatedRefreshTokenRetention = 7 * 24 * time.Hour
+)
+
+var errMissingRefreshToken = errors.New("no refresh token in header or cookie")
+
+func setAccessTokenCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.AccessTokenCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(accessTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func setRefreshTokenCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    token,
+		Path:     "/api/",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// setSessionCookies starts a cookie session with a fresh CSRF token.
+func setSessionCookies(w http.ResponseWriter, accessToken, refreshToken string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	setAccessTokenCookie(w, accessToken)
+	setRefreshTokenCookie(w, refreshToken)
+	// Not HttpOnly: the page has to read it to send it back as a header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    hex.EncodeToString(b),
+		Path:     "/",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		auth.AccessTokenCookie: "/",
+		refreshTokenCookie:     "/api/",
+		csrfCookie:             "/",
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     path,
+			MaxAge:   -1,
+			HttpOnly: name != csrfCookie,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// usesCookieSession reports whether the request is authenticated by session
+// cookies rather than an Authorization header.
+func usesCookieSession(req *http.Request) bool {
+	if req.Header.Get("Authorization") != "" {
+		return false
+	}
+	for _, name := range []string{auth.AccessTokenCookie, refreshTokenCookie} {
+		if _, err := req.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshTokenFromRequest returns the refresh token from the Authorization
+// header, or from the refresh token cookie when there is no header.
+func refreshTokenFromRequest(req *http.Request) (string, error) {
+	token, err := auth.GetBearerToken(req.Header)
+	if !errors.Is(err, auth.ErrNoAuthHeader) {
+		return token, err
+	}
+	cookie, err := req.Cookie(refreshTokenCookie)
+	if err != nil {
+		return "", errMissingRefreshToken
+	}
+	return cookie.Value, nil
+}
+
+// middlewareCSRF rejects cookie-authenticated requests whose X-CSRF-Token
+// header does not match the csrf_token cookie. Requests that carry their
+// own Authorization header cannot be forged cross-site and pass through, as
+// do safe methods, which must not change anything.
+func middlewareCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isSafeMethod(req.Method) && usesCookieSession(req) {
+			cookie, err := req.Cookie(csrfCookie)
+			header := req.Header.Get(csrfHeader)
+			if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+				slog.WarnContext(req.Context(), "CSRF token missing or mismatched", "method", req.Method, "path", req.URL.Path)
+				respondWithError(w, req, http.StatusForbidden, "Invalid CSRF token", nil)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
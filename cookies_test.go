@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+)
+
+func TestMiddlewareCSRF(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		cookies map[string]string
+		headers map[string]string
+		want    int
+	}{
+		{
+			name:    "cookie session without header",
+			method:  http.MethodPost,
+			cookies: map[string]string{auth.AccessTokenCookie: "jwt", csrfCookie: "abc"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "cookie session with mismatched header",
+			method:  http.MethodPost,
+			cookies: map[string]string{auth.AccessTokenCookie: "jwt", csrfCookie: "abc"},
+			headers: map[string]string{csrfHeader: "abd"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "cookie session without csrf cookie",
+			method:  http.MethodPost,
+			cookies: map[string]string{refreshTokenCookie: "rt"},
+			headers: map[string]string{csrfHeader: "abc"},
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "cookie session with matching header",
+			method:  http.MethodPost,
+			cookies: map[string]string{auth.AccessTokenCookie: "jwt", csrfCookie: "abc"},
+			headers: map[string]string{csrfHeader: "abc"},
+			want:    http.StatusOK,
+		},
+		{
+			name:    "authorization header bypasses check",
+			method:  http.MethodPost,
+			cookies: map[string]string{auth.AccessTokenCookie: "jwt", csrfCookie: "abc"},
+			headers: map[string]string{"Authorization": "Bearer jwt"},
+			want:    http.StatusOK,
+		},
+		{
+			name:   "no session",
+			method: http.MethodPost,
+			want:   http.StatusOK,
+		},
+		{
+			name:    "safe method",
+			method:  http.MethodGet,
+			cookies: map[string]string{auth.AccessTokenCookie: "jwt", csrfCookie: "abc"},
+			want:    http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := middlewareCSRF(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+			req := httptest.NewRequest(tt.method, "/api/chirps", nil)
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsesCookieSession(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+	if usesCookieSession(req) {
+		t.Error("request without cookies uses a cookie session")
+	}
+	req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: "rt"})
+	if !usesCookieSession(req) {
+		t.Error("request with a refresh token cookie doesn't use a cookie session")
+	}
+	req.Header.Set("Authorization", "Bearer rt")
+	if usesCookieSession(req) {
+		t.Error("request with an Authorization header uses a cookie session")
+	}
+}
+
+func TestRefreshTokenFromRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+	if _, err := refreshTokenFromRequest(req); err != errMissingRefreshToken {
+		t.Errorf("got error %v, want errMissingRefreshToken", err)
+	}
+	req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: "from-cookie"})
+	if got, err := refreshTokenFromRequest(req); err != nil || got != "from-cookie" {
+		t.Errorf("got %q, %v; want the cookie", got, err)
+	}
+	req.Header.Set("Authorization", "Bearer from-header")
+	if got, err := refreshTokenFromRequest(req); err != nil || got != "from-header" {
+		t.Errorf("got %q, %v; want the header", got, err)
+	}
+}
+
+func TestSetSessionCookies(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := setSessionCookies(rec, "jwt", "rt"); err != nil {
+		t.Fatal(err)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if c := cookies[auth.AccessTokenCookie]; c == nil || c.Value != "jwt" || !c.HttpOnly {
+		t.Errorf("access token cookie = %+v", c)
+	}
+	if c := cookies[refreshTokenCookie]; c == nil || c.Value != "rt" || !c.HttpOnly || c.Path != "/api/" {
+		t.Errorf("refresh token cookie = %+v", c)
+	}
+	if c := cookies[csrfCookie]; c == nil || len(c.Value) != 64 || c.HttpOnly {
+		t.Errorf("csrf cookie = %+v", c)
+	}
+}
+
+func TestRespondWithRefreshedTokens(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: "old"})
+	rec := httptest.NewRecorder()
+	respondWithRefreshedTokens(rec, req, "jwt", "new")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	cookies := map[string]string{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	if cookies[auth.AccessTokenCookie] != "jwt" || cookies[refreshTokenCookie] != "new" {
+		t.Errorf("got cookies %v", cookies)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/refresh", nil)
+	req.Header.Set("Authorization", "Bearer old")
+	rec = httptest.NewRecorder()
+	respondWithRefreshedTokens(rec, req, "jwt", "new")
+	if rec.Code != http.StatusOK || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("header session got status %d and cookies %v", rec.Code, rec.Result().Cookies())
+	}
+}
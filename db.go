@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/lib/pq"
+)
+
+// withTx runs fn inside a transaction, committing when it returns nil and
+// rolling back otherwise.
+func (cfg *apiConfig) withTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := cfg.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(cfg.db.WithTx(tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isUniqueViolation reports whether err is Postgres refusing a duplicate in
+// the unique constraint or index named constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
@@ -9,6 +9,8 @@ require (
 
 require (
 	github.com/golang-jwt/jwt/v4 v4.5.1
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/joho/godotenv v1.5.1
 	golang.org/x/crypto v0.31.0
 )
+
+require golang.org/x/sys v0.28.0 // indirect
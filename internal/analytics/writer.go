@@ -0,0 +1,152 @@
+// Package analytics records page views off the request path. Hits are queued
+// in memory and written out in batches by a single background goroutine.
+package analytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hit is a single page view.
+type Hit struct {
+	Path string
+	At   time.Time
+}
+
+// FlushFunc persists a batch of hits. The slice is reused once it returns.
+type FlushFunc func(ctx context.Context, hits []Hit) error
+
+type Options struct {
+	// BufferSize is how many hits may be queued before new ones are dropped.
+	BufferSize int
+	// BatchSize is the largest number of hits handed to a single flush.
+	BatchSize int
+	// FlushInterval is how long a partial batch may wait before it is flushed.
+	FlushInterval time.Duration
+	// FlushTimeout bounds each call to the FlushFunc.
+	FlushTimeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.BufferSize <= 0 {
+		o.BufferSize = 4096
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 5 * time.Second
+	}
+	if o.FlushTimeout <= 0 {
+		o.FlushTimeout = 10 * time.Second
+	}
+	return o
+}
+
+var ErrClosed = errors.New("analytics: writer closed")
+
+// Writer batches hits and flushes them in the background.
+type Writer struct {
+	flush FlushFunc
+	opts  Options
+	hits  chan Hit
+	done  chan struct{}
+
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	closed    bool
+	dropped   atomic.Uint64
+}
+
+// NewWriter starts the background flusher. Call Close to stop it.
+func NewWriter(flush FlushFunc, opts Options) *Writer {
+	opts = opts.withDefaults()
+	w := &Writer{
+		flush: flush,
+		opts:  opts,
+		hits:  make(chan Hit, opts.BufferSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Record queues a hit without blocking. It reports false when the hit was
+// dropped because the buffer is full or the writer has been closed.
+func (w *Writer) Record(path string, at time.Time) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return false
+	}
+	select {
+	case w.hits <- Hit{Path: path, At: at}:
+		return true
+	default:
+		w.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped is the number of hits that could not be queued.
+func (w *Writer) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Close stops accepting hits and flushes whatever is queued. It returns
+// ctx.Err() if the final flush does not finish in time.
+func (w *Writer) Close(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		close(w.hits)
+		w.mu.Unlock()
+	})
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Hit, 0, w.opts.BatchSize)
+	for {
+		select {
+		case hit, ok := <-w.hits:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, hit)
+			if len(batch) >= w.opts.BatchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (w *Writer) write(batch []Hit) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.FlushTimeout)
+	defer cancel()
+	if err := w.flush(ctx, batch); err != nil {
+		slog.Error("failed to flush page hits", "count", len(batch), "error", err)
+	}
+}
@@ -0,0 +1,100 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]Hit
+}
+
+func (r *recorder) flush(ctx context.Context, hits []Hit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, append([]Hit(nil), hits...))
+	return nil
+}
+
+func (r *recorder) total() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, b := range r.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func TestWriterBatchesAndDrainsOnClose(t *testing.T) {
+	rec := &recorder{}
+	w := NewWriter(rec.flush, Options{BatchSize: 2, FlushInterval: time.Hour})
+	now := time.Now()
+	for _, p := range []string{"/app/index.html", "/app/test.html", "/app/index.html"} {
+		if !w.Record(p, now) {
+			t.Errorf("Hit for %s was dropped", p)
+		}
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Errorf("Error closing writer: %s", err)
+	}
+	if rec.total() != 3 {
+		t.Errorf("Expected 3 flushed hits, got %d", rec.total())
+	}
+	for _, b := range rec.batches {
+		if len(b) > 2 {
+			t.Errorf("Batch of %d exceeds batch size 2", len(b))
+		}
+	}
+	if w.Record("/app/late.html", now) {
+		t.Errorf("Record succeeded after Close")
+	}
+}
+
+func TestWriterFlushesOnInterval(t *testing.T) {
+	rec := &recorder{}
+	w := NewWriter(rec.flush, Options{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer w.Close(context.Background())
+	w.Record("/app/index.html", time.Now())
+
+	deadline := time.Now().Add(time.Second)
+	for rec.total() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rec.total() != 1 {
+		t.Errorf("Expected partial batch to be flushed on interval, got %d hits", rec.total())
+	}
+}
+
+func TestWriterDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	flush := func(ctx context.Context, hits []Hit) error {
+		<-block
+		return nil
+	}
+	w := NewWriter(flush, Options{BufferSize: 1, BatchSize: 1, FlushInterval: time.Hour})
+
+	// The first hit is taken by the flusher, which then blocks, the second
+	// fills the buffer and everything after must be dropped immediately.
+	accepted := 0
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if w.Record("/app/index.html", time.Now()) {
+			accepted++
+		}
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Record blocked while the buffer was full")
+	}
+	if accepted > 2 {
+		t.Errorf("Expected at most 2 accepted hits, got %d", accepted)
+	}
+	if w.Dropped() != uint64(10-accepted) {
+		t.Errorf("Expected %d dropped hits, got %d", 10-accepted, w.Dropped())
+	}
+	close(block)
+	w.Close(context.Background())
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// API keys look like chirpy_<prefix>_<secret>. The prefix isn't secret: it
+// identifies the key in listings and is what it is looked up by. Only a hash
+// of the whole key is stored.
+const (
+	apiKeyTag          = "chirpy_"
+	apiKeyPrefixLength = 12
+	apiKeySecretLength = 64
+)
+
+// Scopes limit what an API key or OAuth client may be used for. Reading
+// chirps needs no credentials at all, so there is no scope for it.
+const (
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileWrite = "profile:write"
+)
+
+var scopes = []string{ScopeChirpsWrite, ScopeProfileWrite}
+
+// ValidScope reports whether scope is one API keys can be granted.
+func ValidScope(scope string) bool {
+	return slices.Contains(scopes, scope)
+}
+
+// Scopes returns every scope there is.
+func Scopes() []string {
+	return slices.Clone(scopes)
+}
+
+// HasScope reports whether the space-separated scope list granted includes
+// scope.
+func HasScope(granted, scope string) bool {
+	return slices.Contains(strings.Fields(granted), scope)
+}
+
+// MakeAPIKey returns a new API key and its prefix.
+func MakeAPIKey() (key, prefix string, err error) {
+	b := make([]byte, (apiKeyPrefixLength+apiKeySecretLength)/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	s := hex.EncodeToString(b)
+	prefix, secret := s[:apiKeyPrefixLength], s[apiKeyPrefixLength:]
+	return apiKeyTag + prefix + "_" + secret, prefix, nil
+}
+
+// IsAPIKey reports whether a bearer token is meant as an API key rather
+// than a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyTag)
+}
+
+// ParseAPIKey returns the prefix of key, or false if key is not shaped like
+// one made by MakeAPIKey.
+func ParseAPIKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyTag)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(prefix) != apiKeyPrefixLength || len(secret) != apiKeySecretLength || !isHex(prefix) || !isHex(secret) {
+		return "", false
+	}
+	return prefix, true
+}
+
+// HashAPIKey returns the stored form of an API key. Like refresh tokens,
+// keys are random enough that a plain SHA-256 suffices.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	key, prefix, err := MakeAPIKey()
+	if err != nil {
+		t.Fatalf("MakeAPIKey: %v", err)
+	}
+	if !IsAPIKey(key) {
+		t.Errorf("IsAPIKey(%q) = false", key)
+	}
+	got, ok := ParseAPIKey(key)
+	if !ok || got != prefix {
+		t.Errorf("ParseAPIKey(%q) = %q, %v, want %q, true", key, got, ok, prefix)
+	}
+	if !strings.HasPrefix(key, "chirpy_"+prefix+"_") {
+		t.Errorf("key %q does not start with its prefix %q", key, prefix)
+	}
+	other, _, _ := MakeAPIKey()
+	if other == key || HashAPIKey(other) == HashAPIKey(key) {
+		t.Error("two keys should differ, and so should their hashes")
+	}
+	if HashAPIKey(key) == key {
+		t.Error("HashAPIKey should not return the key itself")
+	}
+
+	for _, bad := range []string{
+		"",
+		"chirpy_",
+		strings.TrimPrefix(key, "chirpy_"),
+		key[:len(key)-1],
+		key + "0",
+		strings.Replace(key, "_", "-", -1),
+		"chirpy_" + strings.Repeat("z", 12) + "_" + strings.Repeat("0", 64),
+	} {
+		if _, ok := ParseAPIKey(bad); ok {
+			t.Errorf("ParseAPIKey(%q) accepted a malformed key", bad)
+		}
+	}
+	if IsAPIKey("eyJhbGciOiJIUzI1NiJ9.e30.sig") {
+		t.Error("a JWT should not be taken for an API key")
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	for _, scope := range []string{ScopeChirpsWrite, ScopeProfileWrite} {
+		if !ValidScope(scope) {
+			t.Errorf("ValidScope(%q) = false", scope)
+		}
+	}
+	for _, scope := range []string{"", "admin", "chirps:*", "chirps:read", "CHIRPS:WRITE"} {
+		if ValidScope(scope) {
+			t.Errorf("ValidScope(%q) = true", scope)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	granted := "chirps:read " + ScopeProfileWrite
+	if !HasScope(granted, ScopeProfileWrite) {
+		t.Errorf("HasScope(%q, %q) = false", granted, ScopeProfileWrite)
+	}
+	for _, scope := range []string{ScopeChirpsWrite, "", "chirps"} {
+		if HasScope(granted, scope) {
+			t.Errorf("HasScope(%q, %q) = true", granted, scope)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -10,60 +12,132 @@ import (
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	if err != nil {
-		return "", err
-	}
-	return string(hash), nil
+// Claims are the chirpy-specific contents of an access token.
+type Claims struct {
+	UserID uuid.UUID
+	// SessionID is the refresh token family the access token was issued
+	// for, or uuid.Nil for tokens not tied to a session.
+	SessionID uuid.UUID
+	// TokenVersion must match the user's current version for the token to
+	// be accepted; bumping it invalidates every outstanding access token.
+	TokenVersion int32
+	// Scope is the space-separated list of scopes an OAuth client was
+	// granted. It is empty for tokens from a user's own login, which are
+	// not limited.
+	Scope string
 }
 
-func CheckPasswordHash(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionID    string `json:"sid,omitempty"`
+	TokenVersion int32  `json:"ver"`
+	Scope        string `json:"scope,omitempty"`
+	// TokenUse is empty for access tokens and names the purpose of any
+	// other token signed with the same keys, so one can't stand in for
+	// another.
+	TokenUse string `json:"token_use,omitempty"`
 }
 
+// TokenVersionFunc looks up a user's current token version.
+type TokenVersionFunc func(userID uuid.UUID) (int32, error)
+
+var ErrTokenVersionMismatch = errors.New("token has been invalidated")
+
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	now := time.Now().UTC()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		Subject:   userID.String(),
-		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
-		IssuedAt:  jwt.NewNumericDate(now),
-	})
-	fullToken, err := token.SignedString([]byte(tokenSecret))
-	if err != nil {
-		return "", err
-	}
-	return fullToken, nil
+	return MakeSessionJWT(Claims{UserID: userID}, tokenSecret, expiresIn)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(tokenSecret), nil
-	})
-	if err != nil {
-		return uuid.UUID{}, err
-	}
-	id, err := uuid.Parse(token.Claims.(*jwt.RegisteredClaims).Subject)
+// MakeSessionJWT is MakeJWT for a token bound to a session and token version.
+func MakeSessionJWT(claims Claims, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return NewHMACKeySet(tokenSecret).MakeSessionJWT(claims, expiresIn)
+}
+
+func ValidateJWT(tokenString, tokenSecret string, currentVersion TokenVersionFunc) (uuid.UUID, error) {
+	claims, err := ParseJWT(tokenString, tokenSecret, currentVersion)
 	if err != nil {
 		return uuid.UUID{}, err
 	}
-	return id, nil
+	return claims.UserID, nil
 }
 
+// ParseJWT validates an HS256 access token signed with tokenSecret; see
+// KeySet.ParseJWT.
+func ParseJWT(tokenString, tokenSecret string, currentVersion TokenVersionFunc) (Claims, error) {
+	return NewHMACKeySet(tokenSecret).ParseJWT(tokenString, currentVersion)
+}
+
+var (
+	ErrNoAuthHeader    = errors.New("no authorization header")
+	ErrWrongAuthScheme = errors.New("authorization scheme is not Bearer")
+	ErrMalformedBearer = errors.New("malformed bearer token")
+)
+
+// AccessTokenCookie is the cookie browser clients may carry their access
+// token in instead of an Authorization header.
+const AccessTokenCookie = "access_token"
+
+// GetBearerToken extracts the token from an RFC 6750 "Authorization: Bearer"
+// header. The scheme is matched case-insensitively and surrounding
+// whitespace is ignored, but anything other than a single b64token after the
+// scheme is rejected with ErrMalformedBearer.
 func GetBearerToken(headers http.Header) (string, error) {
-	bearer := headers.Get("Authorization")
-	if bearer == "" {
-		return "", fmt.Errorf("Error: no auth header found")
+	values := headers.Values("Authorization")
+	if len(values) == 0 {
+		return "", ErrNoAuthHeader
+	}
+	if len(values) > 1 {
+		return "", fmt.Errorf("%w: multiple authorization headers", ErrMalformedBearer)
+	}
+	fields := strings.Fields(values[0])
+	if len(fields) == 0 {
+		return "", ErrNoAuthHeader
+	}
+	if !strings.EqualFold(fields[0], "Bearer") {
+		return "", fmt.Errorf("%w: got %.20q", ErrWrongAuthScheme, fields[0])
+	}
+	if len(fields) != 2 || !isB64Token(fields[1]) {
+		return "", ErrMalformedBearer
+	}
+	return fields[1], nil
+}
+
+// GetAccessToken returns the bearer token from the Authorization header, or
+// the AccessTokenCookie when the request has no Authorization header. A
+// present but invalid header is an error rather than a reason to fall back
+// to the cookie.
+func GetAccessToken(req *http.Request) (string, error) {
+	token, err := GetBearerToken(req.Header)
+	if !errors.Is(err, ErrNoAuthHeader) {
+		return token, err
 	}
-	token := strings.Split(bearer, " ")
-	if len(token) != 2 {
-		return "", fmt.Errorf("Error: Malformed bearer token - %s", bearer)
+	cookie, cookieErr := req.Cookie(AccessTokenCookie)
+	if cookieErr != nil {
+		return "", err
+	}
+	if !isB64Token(cookie.Value) {
+		return "", ErrMalformedBearer
+	}
+	return cookie.Value, nil
+}
+
+// isB64Token reports whether s matches the b64token rule of RFC 6750
+// section 2.1.
+func isB64Token(s string) bool {
+	s = strings.TrimRight(s, "=")
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("-._~+/", c):
+		default:
+			return false
+		}
 	}
-	return token[1], nil
+	return true
 }
 
 func MakeRefreshToken() (string, error) {
@@ -75,3 +149,11 @@ func MakeRefreshToken() (string, error) {
 	refresh_token := hex.EncodeToString(randBytes)
 	return refresh_token, nil
 }
+
+// HashRefreshToken returns the form of a refresh token that is stored in the
+// database. Refresh tokens are 256 random bits, so a plain SHA-256 is enough
+// to make a leaked table useless without slowing down every refresh.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,11 +1,15 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,11 +20,14 @@ func TestHashPassword(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error generating password: %s", err)
 	}
-	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("%v should be an argon2id hash", hash)
+	}
+	if CheckPasswordHash(password, hash) != nil {
 		t.Errorf("%v should hash %s correctly", hash, password)
 	}
 	notPass := "somethingelse"
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(notPass))
+	err = CheckPasswordHash(notPass, hash)
 	if err != bcrypt.ErrMismatchedHashAndPassword {
 		t.Errorf("%v and %s should be mismatched", hash, notPass)
 	}
@@ -53,24 +60,65 @@ func TestJWT(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error when creating JWT: %s", err)
 	}
-	validatedID, err := ValidateJWT(token, password)
+	validatedID, err := ValidateJWT(token, password, nil)
 	if err != nil {
 		t.Errorf("Error when validating JWT: %s", err)
 	}
 	if validatedID != id {
 		t.Errorf("Valided ID %v did not match starting ID %v", validatedID, id)
 	}
-	wrongID, err := ValidateJWT(token, "wrongpassword")
+	wrongID, err := ValidateJWT(token, "wrongpassword", nil)
 	if err == nil {
 		t.Errorf("No error when using wrong password, got id %v", wrongID)
 	}
 	time.Sleep(duration)
-	expiredToken, err := ValidateJWT(token, password)
+	expiredToken, err := ValidateJWT(token, password, nil)
 	if err == nil {
 		t.Errorf("No error when using expired token, got token %v", expiredToken)
 	}
 }
 
+func TestSessionJWT(t *testing.T) {
+	userID := uuid.New()
+	sessionID := uuid.New()
+	secret := "chirpy"
+	token, err := MakeSessionJWT(Claims{UserID: userID, SessionID: sessionID, TokenVersion: 3}, secret, time.Minute)
+	if err != nil {
+		t.Errorf("Error when creating JWT: %s", err)
+	}
+
+	current := func(id uuid.UUID) (int32, error) {
+		if id != userID {
+			t.Errorf("Version looked up for %v, expected %v", id, userID)
+		}
+		return 3, nil
+	}
+	claims, err := ParseJWT(token, secret, current)
+	if err != nil {
+		t.Errorf("Error when validating JWT: %s", err)
+	}
+	if claims.UserID != userID || claims.SessionID != sessionID || claims.TokenVersion != 3 {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	bumped := func(uuid.UUID) (int32, error) { return 4, nil }
+	if _, err := ValidateJWT(token, secret, bumped); !errors.Is(err, ErrTokenVersionMismatch) {
+		t.Errorf("Expected ErrTokenVersionMismatch for stale token, got %v", err)
+	}
+
+	plain, err := MakeJWT(userID, secret, time.Minute)
+	if err != nil {
+		t.Errorf("Error when creating JWT: %s", err)
+	}
+	claims, err = ParseJWT(plain, secret, nil)
+	if err != nil {
+		t.Errorf("Error when validating JWT: %s", err)
+	}
+	if claims.SessionID != uuid.Nil || claims.TokenVersion != 0 {
+		t.Errorf("Plain token should have no session or version, got %+v", claims)
+	}
+}
+
 func TestBearerToken(t *testing.T) {
 	req, err := http.NewRequest("GET", "https://www.example.com", nil)
 	if err != nil {
@@ -102,3 +150,236 @@ func TestBearerToken(t *testing.T) {
 		t.Errorf("No Error when trying to pull bearer token")
 	}
 }
+
+func TestBearerTokenParsing(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+		err    error
+	}{
+		{"Bearer abc.def-ghi_jkl~", "abc.def-ghi_jkl~", nil},
+		{"bearer abc", "abc", nil},
+		{"BEARER abc", "abc", nil},
+		{"  Bearer \t abc  ", "abc", nil},
+		{"Bearer abc+/==", "abc+/==", nil},
+		{"", "", ErrNoAuthHeader},
+		{"   ", "", ErrNoAuthHeader},
+		{"Basic abc", "", ErrWrongAuthScheme},
+		{"ApiKey abc", "", ErrWrongAuthScheme},
+		{"Bearerabc", "", ErrWrongAuthScheme},
+		{"abc", "", ErrWrongAuthScheme},
+		{"Bearer", "", ErrMalformedBearer},
+		{"Bearer abc def", "", ErrMalformedBearer},
+		{"Bearer ab=c", "", ErrMalformedBearer},
+		{"Bearer ===", "", ErrMalformedBearer},
+		{"Bearer abc,def", "", ErrMalformedBearer},
+	}
+	for _, c := range cases {
+		headers := http.Header{}
+		headers.Set("Authorization", c.header)
+		got, err := GetBearerToken(headers)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%q: expected error %v, got %v", c.header, c.err, err)
+		}
+		if got != c.want {
+			t.Errorf("%q: expected token %q, got %q", c.header, c.want, got)
+		}
+	}
+
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer abc")
+	headers.Add("Authorization", "Bearer def")
+	if _, err := GetBearerToken(headers); !errors.Is(err, ErrMalformedBearer) {
+		t.Errorf("Expected ErrMalformedBearer for repeated header, got %v", err)
+	}
+}
+
+func TestAccessTokenCookie(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/chirps", nil)
+	if _, err := GetAccessToken(req); !errors.Is(err, ErrNoAuthHeader) {
+		t.Errorf("Expected ErrNoAuthHeader, got %v", err)
+	}
+
+	req.AddCookie(&http.Cookie{Name: AccessTokenCookie, Value: "from-cookie"})
+	if got, err := GetAccessToken(req); err != nil || got != "from-cookie" {
+		t.Errorf("Expected cookie token, got %q, %v", got, err)
+	}
+
+	// The header wins over the cookie, and a bad header is not ignored.
+	req.Header.Set("Authorization", "Bearer from-header")
+	if got, err := GetAccessToken(req); err != nil || got != "from-header" {
+		t.Errorf("Expected header token, got %q, %v", got, err)
+	}
+	req.Header.Set("Authorization", "Basic from-header")
+	if _, err := GetAccessToken(req); !errors.Is(err, ErrWrongAuthScheme) {
+		t.Errorf("Expected ErrWrongAuthScheme, got %v", err)
+	}
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	token, err := MakeRefreshToken()
+	if err != nil {
+		t.Errorf("Error creating refresh token: %s", err)
+	}
+	hash := HashRefreshToken(token)
+	if hash == token {
+		t.Errorf("Hash %s should not equal the token", hash)
+	}
+	if HashRefreshToken(token) != hash {
+		t.Errorf("Hashing %s should be deterministic", token)
+	}
+	// Must match Postgres' encode(sha256(...), 'hex') used by the migration.
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := HashRefreshToken("abc"); got != want {
+		t.Errorf("HashRefreshToken(abc) = %s, want %s", got, want)
+	}
+}
+
+// signHS256 signs arbitrary claims, bypassing MakeJWT's defaults.
+func signHS256(t *testing.T, method jwt.SigningMethod, claims jwt.Claims, secret string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Error signing token: %s", err)
+	}
+	return token
+}
+
+func validClaims() jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    "chirpy",
+		Subject:   uuid.NewString(),
+		Audience:  jwt.ClaimStrings{"chirpy-api"},
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		NotBefore: jwt.NewNumericDate(now),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+}
+
+func TestValidateJWTRejects(t *testing.T) {
+	secret := "chirpy"
+	keys := NewHMACKeySet(secret).WithValidation(Validation{Audience: "chirpy-api"})
+
+	good := signHS256(t, jwt.SigningMethodHS256, validClaims(), secret)
+	if _, err := keys.ParseJWT(good, nil); err != nil {
+		t.Fatalf("Baseline token should be valid: %s", err)
+	}
+
+	wrongIssuer := validClaims()
+	wrongIssuer.Issuer = "not-chirpy"
+	wrongAudience := validClaims()
+	wrongAudience.Audience = jwt.ClaimStrings{"another-service"}
+	noAudience := validClaims()
+	noAudience.Audience = nil
+	notYet := validClaims()
+	notYet.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+	noExpiry := validClaims()
+	noExpiry.ExpiresAt = nil
+	noSubject := validClaims()
+	noSubject.Subject = ""
+	nilSubject := validClaims()
+	nilSubject.Subject = uuid.Nil.String()
+	badSubject := validClaims()
+	badSubject.Subject = "not-a-uuid"
+
+	// Swap in another user's claims but keep the original signature.
+	other := validClaims()
+	parts := strings.Split(signHS256(t, jwt.SigningMethodHS256, other, "unrelated"), ".")
+	tampered := strings.Join([]string{parts[0], parts[1], strings.Split(good, ".")[2]}, ".")
+
+	noneToken, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("Error creating unsigned token: %s", err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong issuer", signHS256(t, jwt.SigningMethodHS256, wrongIssuer, secret), ErrWrongIssuer},
+		{"wrong audience", signHS256(t, jwt.SigningMethodHS256, wrongAudience, secret), ErrWrongAudience},
+		{"missing audience", signHS256(t, jwt.SigningMethodHS256, noAudience, secret), ErrWrongAudience},
+		{"not yet valid", signHS256(t, jwt.SigningMethodHS256, notYet, secret), ErrTokenNotYetValid},
+		{"no expiry", signHS256(t, jwt.SigningMethodHS256, noExpiry, secret), ErrMissingExpiry},
+		{"empty subject", signHS256(t, jwt.SigningMethodHS256, noSubject, secret), ErrMissingSubject},
+		{"nil subject", signHS256(t, jwt.SigningMethodHS256, nilSubject, secret), ErrMissingSubject},
+		{"non-UUID subject", signHS256(t, jwt.SigningMethodHS256, badSubject, secret), ErrInvalidSubject},
+		{"wrong alg HS384", signHS256(t, jwt.SigningMethodHS384, validClaims(), secret), ErrUnexpectedAlg},
+		{"alg none", noneToken, ErrUnexpectedAlg},
+		{"tampered payload", tampered, jwt.ErrSignatureInvalid},
+		{"wrong secret", signHS256(t, jwt.SigningMethodHS256, validClaims(), "wrongpassword"), jwt.ErrSignatureInvalid},
+	}
+	for _, c := range cases {
+		if _, err := keys.ParseJWT(c.token, nil); !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestValidateJWTLeeway(t *testing.T) {
+	secret := "chirpy"
+	claims := validClaims()
+	claims.Audience = nil
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Second))
+	expired := signHS256(t, jwt.SigningMethodHS256, claims, secret)
+
+	strict := NewHMACKeySet(secret)
+	if _, err := strict.ParseJWT(expired, nil); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired without leeway, got %v", err)
+	}
+	lenient := NewHMACKeySet(secret).WithValidation(Validation{Leeway: 30 * time.Second})
+	if _, err := lenient.ParseJWT(expired, nil); err != nil {
+		t.Errorf("Token within leeway should be accepted: %s", err)
+	}
+
+	claims = validClaims()
+	claims.Audience = nil
+	claims.NotBefore = jwt.NewNumericDate(time.Now().Add(10 * time.Second))
+	early := signHS256(t, jwt.SigningMethodHS256, claims, secret)
+	if _, err := strict.ParseJWT(early, nil); !errors.Is(err, ErrTokenNotYetValid) {
+		t.Errorf("Expected ErrTokenNotYetValid without leeway, got %v", err)
+	}
+	if _, err := lenient.ParseJWT(early, nil); err != nil {
+		t.Errorf("Token within leeway should be accepted: %s", err)
+	}
+}
+
+func TestMakeJWTSetsAudience(t *testing.T) {
+	keys := NewHMACKeySet("chirpy").WithValidation(Validation{Audience: "chirpy-api"})
+	token, err := keys.MakeSessionJWT(Claims{UserID: uuid.New()}, time.Minute)
+	if err != nil {
+		t.Fatalf("Error creating JWT: %s", err)
+	}
+	if _, err := keys.ParseJWT(token, nil); err != nil {
+		t.Errorf("Token should carry the configured audience: %s", err)
+	}
+	other := NewHMACKeySet("chirpy").WithValidation(Validation{Audience: "other-api"})
+	if _, err := other.ParseJWT(token, nil); !errors.Is(err, ErrWrongAudience) {
+		t.Errorf("Expected ErrWrongAudience, got %v", err)
+	}
+}
+
+func TestEmailVerificationToken(t *testing.T) {
+	keys := NewHMACKeySet("chirpy")
+	claims := Claims{UserID: uuid.New(), TokenVersion: 1}
+	token, err := keys.MakeEmailVerification(claims, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating verification token: %s", err)
+	}
+	if _, err := keys.ParseJWT(token, nil); !errors.Is(err, ErrWrongTokenUse) {
+		t.Errorf("Expected ErrWrongTokenUse for verification token used as access token, got %v", err)
+	}
+	if _, err := keys.ParseMFAChallenge(token, nil); !errors.Is(err, ErrWrongTokenUse) {
+		t.Errorf("Expected ErrWrongTokenUse for verification token used as MFA challenge, got %v", err)
+	}
+	current := func(uuid.UUID) (int32, error) { return 1, nil }
+	if got, err := keys.ParseEmailVerification(token, current); err != nil || got.UserID != claims.UserID {
+		t.Errorf("Expected verification token for %s, got %+v, %v", claims.UserID, got, err)
+	}
+	changed := func(uuid.UUID) (int32, error) { return 2, nil }
+	if _, err := keys.ParseEmailVerification(token, changed); !errors.Is(err, ErrTokenVersionMismatch) {
+		t.Errorf("Expected link to die with a credential change, got %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownKey       = errors.New("token signed with an unknown key")
+	ErrUnexpectedAlg    = errors.New("token signed with an unexpected algorithm")
+	ErrMissingExpiry    = errors.New("token has no expiry")
+	ErrTokenExpired     = errors.New("token has expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrWrongIssuer      = errors.New("token has the wrong issuer")
+	ErrWrongAudience    = errors.New("token was issued for another audience")
+	ErrMissingSubject   = errors.New("token has no subject")
+	ErrInvalidSubject   = errors.New("token subject is not a user id")
+	ErrInvalidSession   = errors.New("token session is not a session id")
+	ErrWrongTokenUse    = errors.New("token was issued for another purpose")
+
+	ErrUnsupportedKey = errors.New("unsupported key type")
+	ErrNoPrivateKey   = errors.New("no private key in PEM data")
+	ErrDuplicateKeyID = errors.New("duplicate key id")
+	errNoSigningKey   = errors.New("key set has no signing key")
+)
+
+// key is one entry of a KeySet. HMAC keys use the same secret for both
+// signing and verifying and are never published.
+type key struct {
+	id     string
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// KeySet signs access tokens with a single active key and verifies them with
+// any key it holds, picked by the token's kid header. Keeping retired public
+// keys in the set lets tokens signed before a rotation stay valid until they
+// expire.
+type KeySet struct {
+	signing    *key
+	keys       map[string]*key
+	validation Validation
+}
+
+// DefaultIssuer is the iss claim of every token chirpy issues.
+const DefaultIssuer = "chirpy"
+
+// Validation configures the registered claims that are set on new tokens
+// and checked by ParseJWT.
+type Validation struct {
+	// Issuer defaults to DefaultIssuer.
+	Issuer string
+	// Audience, when set, is written to new tokens and required on parsed
+	// ones.
+	Audience string
+	// Leeway is the allowed clock skew for exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// WithValidation sets the claim validation rules and returns the key set.
+func (ks *KeySet) WithValidation(v Validation) *KeySet {
+	if v.Issuer == "" {
+		v.Issuer = DefaultIssuer
+	}
+	ks.validation = v
+	return ks
+}
+
+func (ks *KeySet) issuer() string {
+	if ks.validation.Issuer == "" {
+		return DefaultIssuer
+	}
+	return ks.validation.Issuer
+}
+
+// NewHMACKeySet is the legacy single-secret HS256 setup. Anyone able to
+// verify these tokens can also forge them, so prefer asymmetric keys.
+func NewHMACKeySet(secret string) *KeySet {
+	k := &key{method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+	return &KeySet{signing: k, keys: map[string]*key{"": k}}
+}
+
+// LoadKeySet reads the active signing key from a PEM private key file and
+// any number of verification-only keys, e.g. the previous signing key, from
+// PEM public or private key files. RSA keys sign with RS256 and Ed25519 keys
+// with EdDSA. Key ids are RFC 7638 thumbprints, so they are stable across
+// restarts and instances.
+func LoadKeySet(signingKeyFile string, verifyKeyFiles ...string) (*KeySet, error) {
+	data, err := os.ReadFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signing, err := parsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+	}
+	ks := &KeySet{signing: signing, keys: map[string]*key{signing.id: signing}}
+	for _, file := range verifyKeyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parseVerifyKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if _, ok := ks.keys[k.id]; ok {
+			return nil, fmt.Errorf("%s: %w %s", file, ErrDuplicateKeyID, k.id)
+		}
+		ks.keys[k.id] = k
+	}
+	return ks, nil
+}
+
+func parsePrivateKeyPEM(data []byte) (*key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoPrivateKey
+	}
+	var priv interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, ErrNoPrivateKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	k, err := newPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	k.sign = signer
+	return k, nil
+}
+
+func parseVerifyKeyPEM(data []byte) (*key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newPublicKey(pub)
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newPublicKey(pub)
+	}
+	// A private key works as well; only its public half is kept.
+	k, err := parsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	k.sign = nil
+	return k, nil
+}
+
+func newPublicKey(pub crypto.PublicKey) (*key, error) {
+	k := &key{verify: pub}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, pub)
+	}
+	k.id = thumbprint(jwkOf(k))
+	return k, nil
+}
+
+// SigningKeyID is the kid of the active signing key, empty for HMAC.
+func (ks *KeySet) SigningKeyID() string {
+	return ks.signing.id
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil || ks.signing.sign == nil {
+		return "", errNoSigningKey
+	}
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	if ks.signing.id != "" {
+		token.Header["kid"] = ks.signing.id
+	}
+	return token.SignedString(ks.signing.sign)
+}
+
+// keyFunc picks the verification key named by the token's kid and refuses
+// tokens whose algorithm does not match that key.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, ErrUnexpectedAlg
+	}
+	return k.verify, nil
+}
+
+// Values of the token_use claim for tokens other than access tokens.
+const (
+	tokenUseMFA         = "mfa"
+	tokenUseVerifyEmail = "verify_email"
+)
+
+// MakeSessionJWT signs an access token for the given claims.
+func (ks *KeySet) MakeSessionJWT(claims Claims, expiresIn time.Duration) (string, error) {
+	return ks.makeToken(claims, "", expiresIn)
+}
+
+// MakeMFAChallenge signs the token a client that has passed the password
+// check exchanges, together with its second factor, for a session. It is
+// not accepted by ParseJWT.
+func (ks *KeySet) MakeMFAChallenge(claims Claims, expiresIn time.Duration) (string, error) {
+	return ks.makeToken(claims, tokenUseMFA, expiresIn)
+}
+
+// MakeEmailVerification signs the token in an address verification link.
+// It carries the token version, so changing the email or password
+// invalidates links sent before.
+func (ks *KeySet) MakeEmailVerification(claims Claims, expiresIn time.Duration) (string, error) {
+	return ks.makeToken(claims, tokenUseVerifyEmail, expiresIn)
+}
+
+func (ks *KeySet) makeToken(claims Claims, use string, expiresIn time.Duration) (string, error) {
+	now := time.Now().UTC()
+	ac := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ks.issuer(),
+			Subject:   claims.UserID.String(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		TokenVersion: claims.TokenVersion,
+		Scope:        claims.Scope,
+		TokenUse:     use,
+	}
+	if ks.validation.Audience != "" {
+		ac.Audience = jwt.ClaimStrings{ks.validation.Audience}
+	}
+	if claims.SessionID != uuid.Nil {
+		ac.SessionID = claims.SessionID.String()
+	}
+	return ks.sign(ac)
+}
+
+// ParseJWT validates an access token and returns its claims. The signature
+// must come from a key in the set using that key's algorithm, and iss, aud,
+// exp, nbf and iat are checked against the set's Validation. When
+// currentVersion is not nil, tokens minted for an older token version are
+// rejected with ErrTokenVersionMismatch.
+func (ks *KeySet) ParseJWT(tokenString string, currentVersion TokenVersionFunc) (Claims, error) {
+	return ks.parseToken(tokenString, "", currentVersion)
+}
+
+// ParseMFAChallenge validates a token from MakeMFAChallenge like ParseJWT
+// validates access tokens.
+func (ks *KeySet) ParseMFAChallenge(tokenString string, currentVersion TokenVersionFunc) (Claims, error) {
+	return ks.parseToken(tokenString, tokenUseMFA, currentVersion)
+}
+
+// ParseEmailVerification validates a token from MakeEmailVerification.
+func (ks *KeySet) ParseEmailVerification(tokenString string, currentVersion TokenVersionFunc) (Claims, error) {
+	return ks.parseToken(tokenString, tokenUseVerifyEmail, currentVersion)
+}
+
+func (ks *KeySet) parseToken(tokenString, use string, currentVersion TokenVersionFunc) (Claims, error) {
+	// The library's own claim checks have no leeway, so they are replaced
+	// by validateClaims.
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+	token, err := parser.ParseWithClaims(tokenString, &accessClaims{}, ks.keyFunc)
+	if err != nil {
+		return Claims{}, err
+	}
+	ac := token.Claims.(*accessClaims)
+	if err := ks.validateClaims(ac, time.Now()); err != nil {
+		return Claims{}, err
+	}
+	if ac.TokenUse != use {
+		return Claims{}, ErrWrongTokenUse
+	}
+	if ac.Subject == "" {
+		return Claims{}, ErrMissingSubject
+	}
+	id, err := uuid.Parse(ac.Subject)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %s", ErrInvalidSubject, err)
+	}
+	if id == uuid.Nil {
+		return Claims{}, ErrMissingSubject
+	}
+	claims := Claims{UserID: id, TokenVersion: ac.TokenVersion, Scope: ac.Scope}
+	if ac.SessionID != "" {
+		claims.SessionID, err = uuid.Parse(ac.SessionID)
+		if err != nil {
+			return Claims{}, fmt.Errorf("%w: %s", ErrInvalidSession, err)
+		}
+	}
+	if currentVersion != nil {
+		version, err := currentVersion(id)
+		if err != nil {
+			return Claims{}, err
+		}
+		if version != claims.TokenVersion {
+			return Claims{}, ErrTokenVersionMismatch
+		}
+	}
+	return claims, nil
+}
+
+func (ks *KeySet) validateClaims(ac *accessClaims, now time.Time) error {
+	leeway := ks.validation.Leeway
+	if ac.ExpiresAt == nil {
+		return ErrMissingExpiry
+	}
+	if now.After(ac.ExpiresAt.Add(leeway)) {
+		return ErrTokenExpired
+	}
+	if ac.NotBefore != nil && now.Add(leeway).Before(ac.NotBefore.Time) {
+		return ErrTokenNotYetValid
+	}
+	if ac.IssuedAt != nil && now.Add(leeway).Before(ac.IssuedAt.Time) {
+		return ErrTokenNotYetValid
+	}
+	if ac.Issuer != ks.issuer() {
+		return ErrWrongIssuer
+	}
+	if aud := ks.validation.Audience; aud != "" && !ac.VerifyAudience(aud, true) {
+		return ErrWrongAudience
+	}
+	return nil
+}
+
+// JWK is a public key in RFC 7517 JSON Web Key form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func jwkOf(k *key) JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}
+	}
+	return JWK{}
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of a key's required members.
+func thumbprint(j JWK) string {
+	var members interface{}
+	switch j.Kty {
+	case "RSA":
+		// Members must be in lexicographic order with no whitespace.
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.Kty, j.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Crv, j.Kty, j.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS returns the public keys other services need to verify tokens. HMAC
+// secrets are never included.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range ks.sortedKeys() {
+		if _, ok := k.verify.([]byte); ok {
+			continue
+		}
+		j := jwkOf(k)
+		j.Kid = k.id
+		j.Use = "sig"
+		j.Alg = k.method.Alg()
+		set.Keys = append(set.Keys, j)
+	}
+	return set
+}
+
+// sortedKeys lists the signing key first, then the rest by id.
+func (ks *KeySet) sortedKeys() []*key {
+	keys := []*key{ks.signing}
+	var rest []string
+	for id := range ks.keys {
+		if id != ks.signing.id {
+			rest = append(rest, id)
+		}
+	}
+	sort.Strings(rest)
+	for _, id := range rest {
+		keys = append(keys, ks.keys[id])
+	}
+	return keys
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Error writing %s: %s", path, err)
+	}
+	return path
+}
+
+func newRSAKeyFile(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %s", err)
+	}
+	return writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv)), priv
+}
+
+func newEd25519KeyFile(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating Ed25519 key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Error encoding Ed25519 key: %s", err)
+	}
+	return writePEM(t, "ed25519.pem", "PRIVATE KEY", der), pub
+}
+
+func TestKeySetSignAndVerify(t *testing.T) {
+	rsaFile, _ := newRSAKeyFile(t)
+	edFile, _ := newEd25519KeyFile(t)
+	for name, file := range map[string]string{"RS256": rsaFile, "EdDSA": edFile} {
+		ks, err := LoadKeySet(file)
+		if err != nil {
+			t.Errorf("%s: error loading key set: %s", name, err)
+			continue
+		}
+		id := uuid.New()
+		token, err := ks.MakeSessionJWT(Claims{UserID: id}, time.Minute)
+		if err != nil {
+			t.Errorf("%s: error signing token: %s", name, err)
+			continue
+		}
+		claims, err := ks.ParseJWT(token, nil)
+		if err != nil {
+			t.Errorf("%s: error verifying token: %s", name, err)
+		}
+		if claims.UserID != id {
+			t.Errorf("%s: got user %v, want %v", name, claims.UserID, id)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldFile, _ := newRSAKeyFile(t)
+	newFile, _ := newEd25519KeyFile(t)
+
+	oldKeys, err := LoadKeySet(oldFile)
+	if err != nil {
+		t.Fatalf("Error loading key set: %s", err)
+	}
+	oldToken, err := oldKeys.MakeSessionJWT(Claims{UserID: uuid.New()}, time.Minute)
+	if err != nil {
+		t.Fatalf("Error signing token: %s", err)
+	}
+
+	// After rotation the old key only verifies.
+	rotated, err := LoadKeySet(newFile, oldFile)
+	if err != nil {
+		t.Fatalf("Error loading rotated key set: %s", err)
+	}
+	if _, err := rotated.ParseJWT(oldToken, nil); err != nil {
+		t.Errorf("Token signed before rotation should still verify: %s", err)
+	}
+	if rotated.SigningKeyID() == oldKeys.SigningKeyID() {
+		t.Errorf("Rotated key set should sign with the new key")
+	}
+
+	// Once the old key is dropped its tokens are rejected.
+	newOnly, err := LoadKeySet(newFile)
+	if err != nil {
+		t.Fatalf("Error loading key set: %s", err)
+	}
+	if _, err := newOnly.ParseJWT(oldToken, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey for retired key, got %v", err)
+	}
+}
+
+func TestKeySetRejectsHMACForgery(t *testing.T) {
+	file, _ := newRSAKeyFile(t)
+	ks, err := LoadKeySet(file)
+	if err != nil {
+		t.Fatalf("Error loading key set: %s", err)
+	}
+	// An HS256 token with the RSA key's kid must not be accepted.
+	forged := NewHMACKeySet("attacker")
+	forged.signing.id = ks.SigningKeyID()
+	token, err := forged.MakeSessionJWT(Claims{UserID: uuid.New()}, time.Minute)
+	if err != nil {
+		t.Fatalf("Error signing token: %s", err)
+	}
+	if _, err := ks.ParseJWT(token, nil); !errors.Is(err, ErrUnexpectedAlg) {
+		t.Errorf("Expected ErrUnexpectedAlg, got %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaFile, priv := newRSAKeyFile(t)
+	edFile, edPub := newEd25519KeyFile(t)
+	pubDER, err := x509.MarshalPKIXPublicKey(edPub)
+	if err != nil {
+		t.Fatalf("Error encoding public key: %s", err)
+	}
+	edPubFile := writePEM(t, "ed25519.pub", "PUBLIC KEY", pubDER)
+
+	ks, err := LoadKeySet(rsaFile, edPubFile)
+	if err != nil {
+		t.Fatalf("Error loading key set: %s", err)
+	}
+	set := ks.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(set.Keys))
+	}
+	first := set.Keys[0]
+	if first.Kty != "RSA" || first.Alg != "RS256" || first.Use != "sig" || first.Kid != ks.SigningKeyID() {
+		t.Errorf("Unexpected signing JWK %+v", first)
+	}
+	if first.E != "AQAB" || first.N == "" {
+		t.Errorf("Unexpected RSA parameters e=%s n=%q for modulus of %d bits", first.E, first.N, priv.N.BitLen())
+	}
+	if second := set.Keys[1]; second.Kty != "OKP" || second.Crv != "Ed25519" || second.Alg != "EdDSA" {
+		t.Errorf("Unexpected verification JWK %+v", second)
+	}
+
+	// Loading the private half of the same Ed25519 key gives the same kid.
+	edOnly, err := LoadKeySet(edFile)
+	if err != nil {
+		t.Fatalf("Error loading key set: %s", err)
+	}
+	if edOnly.SigningKeyID() != set.Keys[1].Kid {
+		t.Errorf("Key id %s should match %s", edOnly.SigningKeyID(), set.Keys[1].Kid)
+	}
+
+	if hmac := NewHMACKeySet("secret").JWKS(); len(hmac.Keys) != 0 {
+		t.Errorf("HMAC secrets must not be published, got %+v", hmac.Keys)
+	}
+}
+
+func TestThumbprintRFC7638(t *testing.T) {
+	// Example from RFC 7638 section 3.1.
+	j := JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECP" +
+			"ebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2" +
+			"QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vM" +
+			"QFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	if got := thumbprint(j); got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("Unexpected thumbprint %s", got)
+	}
+}
+
+func TestKeySetScopeClaim(t *testing.T) {
+	ks := NewHMACKeySet("secret")
+	want := Claims{UserID: uuid.New(), SessionID: uuid.New(), Scope: ScopeChirpsWrite}
+	token, err := ks.MakeSessionJWT(want, time.Minute)
+	if err != nil {
+		t.Fatalf("error signing token: %s", err)
+	}
+	got, err := ks.ParseJWT(token, nil)
+	if err != nil {
+		t.Fatalf("error verifying token: %s", err)
+	}
+	if got != want {
+		t.Errorf("got claims %+v, want %+v", got, want)
+	}
+}
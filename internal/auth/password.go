@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes are stored as self-describing strings: argon2id in the PHC
+// string format, $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>, and bcrypt in
+// its usual $2a$ form. A PasswordHasher checks both and makes new hashes
+// with the algorithm it is set to, so stored hashes can be upgraded as users
+// log in.
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// MaxPasswordLength bounds the work one hash can cost. bcrypt has its own,
+// lower limit of 72 bytes, past which it would silently ignore the rest.
+const (
+	MaxPasswordLength = 1024
+	maxBcryptLength   = 72
+)
+
+// DefaultBcryptCost is used for new bcrypt hashes unless configured
+// otherwise.
+const DefaultBcryptCost = 12
+
+var (
+	// ErrPasswordMismatch is bcrypt's error, so callers comparing against
+	// either keep working.
+	ErrPasswordMismatch = bcrypt.ErrMismatchedHashAndPassword
+	ErrPasswordTooLong  = errors.New("password is too long")
+	ErrUnknownHash      = errors.New("unrecognized password hash format")
+	ErrMalformedHash    = errors.New("malformed password hash")
+)
+
+// Argon2idParams are the argon2id cost settings. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams are the OWASP-recommended minimum: 19 MiB of memory
+// and two passes.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type PasswordHasher struct {
+	// Algorithm is used for new hashes: Argon2id or Bcrypt.
+	Algorithm  string
+	Argon2id   Argon2idParams
+	BcryptCost int
+}
+
+// DefaultPasswordHasher is what HashPassword and CheckPasswordHash use.
+var DefaultPasswordHasher = &PasswordHasher{
+	Algorithm:  Argon2id,
+	Argon2id:   DefaultArgon2idParams,
+	BcryptCost: DefaultBcryptCost,
+}
+
+func HashPassword(password string) (string, error) {
+	return DefaultPasswordHasher.Hash(password)
+}
+
+func CheckPasswordHash(password, hash string) error {
+	return DefaultPasswordHasher.Check(password, hash)
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		if len(password) > MaxPasswordLength {
+			return "", ErrPasswordTooLong
+		}
+		p := h.Argon2id
+		salt := make([]byte, p.SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+			p.Memory, p.Iterations, p.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	case Bcrypt:
+		if len(password) > maxBcryptLength {
+			return "", ErrPasswordTooLong
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Check returns nil if password matches hash, whichever supported algorithm
+// made it, and ErrPasswordMismatch if it doesn't.
+func (h *PasswordHasher) Check(password, hash string) error {
+	switch {
+	case isArgon2idHash(hash):
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return err
+		}
+		if len(password) > MaxPasswordLength {
+			return ErrPasswordMismatch
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	case isBcryptHash(hash):
+		// bcrypt would only compare the first 72 bytes, which no password
+		// accepted when the hash was made can be longer than.
+		if len(password) > maxBcryptLength {
+			return ErrPasswordMismatch
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	default:
+		return ErrUnknownHash
+	}
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or other
+// settings than h would use now. Call it after a successful Check, when the
+// plaintext is at hand to hash again.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	switch h.Algorithm {
+	case Argon2id:
+		if !isArgon2idHash(hash) {
+			return true
+		}
+		p, salt, _, err := parseArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		p.SaltLength = uint32(len(salt))
+		return p != h.Argon2id
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	default:
+		return false
+	}
+}
+
+func isArgon2idHash(hash string) bool {
+	return strings.HasPrefix(hash, "$"+Argon2id+"$")
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// parseArgon2id splits a PHC argon2id string into its parameters, salt and
+// key. SaltLength and KeyLength come from the decoded values.
+func parseArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	var p Argon2idParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return p, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %s", ErrMalformedHash, err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %s", ErrMalformedHash, err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %s", ErrMalformedHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %s", ErrMalformedHash, err)
+	}
+	if p.Iterations == 0 || p.Parallelism == 0 || len(key) == 0 {
+		return p, nil, nil, ErrMalformedHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
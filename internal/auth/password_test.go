@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2id keeps the tests fast; the parameters don't change the
+// format.
+var cheapArgon2id = Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idHash(t *testing.T) {
+	h := &PasswordHasher{Algorithm: Argon2id, Argon2id: cheapArgon2id}
+	hash, err := h.Hash("chirpy")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q is not in PHC format with the configured parameters", hash)
+	}
+	if err := h.Check("chirpy", hash); err != nil {
+		t.Errorf("Check with the right password: %v", err)
+	}
+	if err := h.Check("chirpz", hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Check with a wrong password = %v, want ErrPasswordMismatch", err)
+	}
+	again, _ := h.Hash("chirpy")
+	if again == hash {
+		t.Error("two hashes of the same password should have different salts")
+	}
+	if h.NeedsRehash(hash) {
+		t.Error("a hash made with the current parameters should not need rehashing")
+	}
+}
+
+func TestCheckAcceptsEitherAlgorithm(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("chirpy"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon := &PasswordHasher{Algorithm: Argon2id, Argon2id: cheapArgon2id}
+	if err := argon.Check("chirpy", string(legacy)); err != nil {
+		t.Errorf("argon2id hasher should still accept bcrypt hashes: %v", err)
+	}
+	if !argon.NeedsRehash(string(legacy)) {
+		t.Error("bcrypt hash should need rehashing when argon2id is preferred")
+	}
+
+	modern, err := argon.Hash("chirpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := &PasswordHasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	if err := bc.Check("chirpy", modern); err != nil {
+		t.Errorf("bcrypt hasher should still accept argon2id hashes: %v", err)
+	}
+	if !bc.NeedsRehash(modern) {
+		t.Error("argon2id hash should need rehashing when bcrypt is preferred")
+	}
+	if bc.NeedsRehash(string(legacy)) {
+		t.Error("bcrypt hash at the configured cost should not need rehashing")
+	}
+}
+
+func TestNeedsRehashOnChangedParameters(t *testing.T) {
+	old := &PasswordHasher{Algorithm: Argon2id, Argon2id: cheapArgon2id}
+	hash, err := old.Hash("chirpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := cheapArgon2id
+	stronger.Iterations = 2
+	if !(&PasswordHasher{Algorithm: Argon2id, Argon2id: stronger}).NeedsRehash(hash) {
+		t.Error("hash made with fewer iterations should need rehashing")
+	}
+
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("chirpy"), bcrypt.MinCost)
+	if !(&PasswordHasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}).NeedsRehash(string(legacy)) {
+		t.Error("bcrypt hash below the configured cost should need rehashing")
+	}
+}
+
+func TestLongPasswords(t *testing.T) {
+	bc := &PasswordHasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	long := strings.Repeat("a", 73)
+	if _, err := bc.Hash(long); !errors.Is(err, ErrPasswordTooLong) {
+		t.Errorf("bcrypt Hash of 73 bytes = %v, want ErrPasswordTooLong", err)
+	}
+	// bcrypt ignores everything past 72 bytes, so a longer password must
+	// not match a hash of its prefix.
+	hash, _ := bc.Hash(long[:72])
+	if err := bc.Check(long, hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Check of a 73-byte password against its 72-byte prefix = %v, want ErrPasswordMismatch", err)
+	}
+
+	argon := &PasswordHasher{Algorithm: Argon2id, Argon2id: cheapArgon2id}
+	hash, err := argon.Hash(long)
+	if err != nil {
+		t.Fatalf("argon2id should hash long passwords: %v", err)
+	}
+	if err := argon.Check(long[:72], hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Error("argon2id must use the whole password")
+	}
+	if _, err := argon.Hash(strings.Repeat("a", MaxPasswordLength+1)); !errors.Is(err, ErrPasswordTooLong) {
+		t.Errorf("Hash past MaxPasswordLength = %v, want ErrPasswordTooLong", err)
+	}
+}
+
+func TestCheckRejectsBadHashes(t *testing.T) {
+	h := &PasswordHasher{Algorithm: Argon2id, Argon2id: cheapArgon2id}
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+	} {
+		if err := h.Check("chirpy", hash); err == nil {
+			t.Errorf("Check accepted malformed hash %q", hash)
+		}
+	}
+}
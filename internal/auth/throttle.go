@@ -0,0 +1,46 @@
+package auth
+
+import "time"
+
+// LoginPolicy decides how long a client has to wait before trying to log in
+// again after a run of failed attempts.
+type LoginPolicy struct {
+	// FreeAttempts is how many failures are allowed before any delay.
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts. It
+	// doubles with each further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold is the number of failures after which the wait is
+	// LockoutDuration. Zero disables lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+// RetryAfter is how long from now the client must wait, or zero if it may
+// try now.
+func (p LoginPolicy) RetryAfter(failures int, lastFailure, now time.Time) time.Duration {
+	var delay time.Duration
+	switch {
+	case p.LockoutThreshold > 0 && failures >= p.LockoutThreshold:
+		delay = p.LockoutDuration
+	case failures >= p.FreeAttempts:
+		delay = p.MaxDelay
+		// Stop shifting before BaseDelay overflows.
+		if n := failures - p.FreeAttempts; n < 32 && p.BaseDelay<<n < p.MaxDelay {
+			delay = p.BaseDelay << n
+		}
+	default:
+		return 0
+	}
+	if wait := lastFailure.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Locked reports whether the policy has locked the account out, as opposed
+// to merely slowing it down.
+func (p LoginPolicy) Locked(failures int) bool {
+	return p.LockoutThreshold > 0 && failures >= p.LockoutThreshold
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginPolicyRetryAfter(t *testing.T) {
+	p := LoginPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	}
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		failures int
+		since    time.Duration
+		want     time.Duration
+	}{
+		{0, 0, 0},
+		{2, 0, 0},
+		{3, 0, time.Second},
+		{4, 0, 2 * time.Second},
+		{5, time.Second, 3 * time.Second},
+		{9, 0, time.Minute},
+		{9, 2 * time.Minute, 0},
+		{10, 0, 15 * time.Minute},
+		{10, 14 * time.Minute, time.Minute},
+		{10, 15 * time.Minute, 0},
+		{200, 0, 15 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := p.RetryAfter(c.failures, last, last.Add(c.since)); got != c.want {
+			t.Errorf("%d failures, %s later: expected %s, got %s", c.failures, c.since, c.want, got)
+		}
+	}
+	if p.Locked(9) || !p.Locked(10) {
+		t.Errorf("Expected lockout to start at 10 failures")
+	}
+
+	noLockout := LoginPolicy{FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Hour}
+	if got := noLockout.RetryAfter(100, last, last); got != time.Hour {
+		t.Errorf("Expected delay capped at MaxDelay, got %s", got)
+	}
+	if noLockout.Locked(100) {
+		t.Errorf("Policy without a threshold should never lock")
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// base32 of the ASCII secret "12345678901234567890" from RFC 6238 appendix B.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8-digit codes; six digits are their last six.
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range cases {
+		got, err := TOTPCode(rfcSecret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("Error computing code: %s", err)
+		}
+		if got != want {
+			t.Errorf("T=%d: expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %s", err)
+	}
+	now := time.Now()
+	code, _ := TOTPCode(secret, TOTPStep(now))
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != TOTPStep(now) {
+		t.Errorf("Expected current code to validate at step %d, got %d, %v", TOTPStep(now), step, ok)
+	}
+	if _, ok := ValidateTOTP(secret, code, now.Add(totpPeriod)); !ok {
+		t.Errorf("Code from the previous step should be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, code, now.Add(3*totpPeriod)); ok {
+		t.Errorf("Code from three steps ago should be rejected")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateTOTP(secret, bad, now); ok {
+			t.Errorf("Code %q should be rejected", bad)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI(rfcSecret, "Chirpy", "walt@breakingbad.com"))
+	if err != nil {
+		t.Fatalf("Error parsing URI: %s", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chirpy:walt@breakingbad.com" {
+		t.Errorf("Unexpected URI %s", u)
+	}
+	if q := u.Query(); q.Get("secret") != rfcSecret || q.Get("issuer") != "Chirpy" || q.Get("digits") != "6" {
+		t.Errorf("Unexpected query %s", u.RawQuery)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("Error generating recovery codes: %s", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected recovery code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+	if HashRecoveryCode("ABCDE-FGHIJ") != HashRecoveryCode("abcde fghij") {
+		t.Errorf("Recovery code hashes should ignore case and separators")
+	}
+}
+
+func TestMFAChallengeIsNotAnAccessToken(t *testing.T) {
+	keys := NewHMACKeySet("chirpy")
+	claims := Claims{UserID: uuid.New(), TokenVersion: 2}
+	challenge, err := keys.MakeMFAChallenge(claims, time.Minute)
+	if err != nil {
+		t.Fatalf("Error creating challenge: %s", err)
+	}
+	if _, err := keys.ParseJWT(challenge, nil); !errors.Is(err, ErrWrongTokenUse) {
+		t.Errorf("Expected ErrWrongTokenUse for challenge used as access token, got %v", err)
+	}
+	got, err := keys.ParseMFAChallenge(challenge, nil)
+	if err != nil || got != claims {
+		t.Errorf("Expected %+v, got %+v, %v", claims, got, err)
+	}
+
+	access, _ := keys.MakeSessionJWT(claims, time.Minute)
+	if _, err := keys.ParseMFAChallenge(access, nil); !errors.Is(err, ErrWrongTokenUse) {
+		t.Errorf("Expected ErrWrongTokenUse for access token used as challenge, got %v", err)
+	}
+}
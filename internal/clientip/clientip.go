@@ -0,0 +1,101 @@
+// Package clientip works out the address a request really came from when
+// chirpy runs behind reverse proxies. Each proxy appends the address it
+// got the request from to X-Forwarded-For, so only the entries added by
+// proxies we trust can be believed: anything to the left of them may have
+// been sent by the client.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// PrivateNetworks are loopback and private address ranges, where reverse
+// proxies usually live.
+var PrivateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// Resolver finds client addresses given the proxies in front of the
+// server.
+type Resolver struct {
+	// Trusted are the networks of the proxies whose X-Forwarded-For
+	// entries are believed. With none, the header is ignored.
+	Trusted []netip.Prefix
+}
+
+// ParseTrusted parses a comma-separated list of CIDR prefixes or single
+// addresses.
+func ParseTrusted(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q: %w", field, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func (r Resolver) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.Trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the right-most address in the chain of the peer and its
+// X-Forwarded-For entries that is not a trusted proxy. If every hop is
+// trusted it is the left-most one; if an entry can't be parsed, the last
+// trusted hop before it.
+func (r Resolver) ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !r.trusted(peer) {
+		return host
+	}
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	ip := peer.Unmap()
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap()
+		if !r.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
@@ -0,0 +1,66 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Resolver{Trusted: trusted}
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"no header", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer ignores header", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"one proxy", "10.0.0.2:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left-most entry", "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1, 192.0.2.7, 10.1.1.1"}, "198.51.100.1"},
+		{"several header lines", "10.0.0.2:1234", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.2:1234", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"trusted peer without header", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"garbage entry", "10.0.0.2:1234", []string{"1.2.3.4, not-an-ip"}, "10.0.0.2"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.2]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 client", "10.0.0.2:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := r.ClientIP(req); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPTrustsNobodyByDefault(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := (Resolver{}).ClientIP(req); got != "127.0.0.1" {
+		t.Errorf("got %q, want the peer address", got)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	prefixes, err := ParseTrusted("10.1.2.3/8,::1, ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "10.0.0.0/8" || prefixes[1].String() != "::1/128" {
+		t.Errorf("got %v", prefixes)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := ParseTrusted(bad); err == nil {
+			t.Errorf("ParseTrusted(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileMailer(t *testing.T) {
+	m := &FileMailer{Dir: t.TempDir(), From: "Chirpy <noreply@chirpy.test>"}
+	err := m.Send(context.Background(), Message{
+		To:      "walt@breakingbad.com",
+		Subject: "Verify your email ✓",
+		Body:    "Line one\nLine two\n",
+	})
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(m.Dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	msg := string(data)
+	for _, want := range []string{
+		"From: Chirpy <noreply@chirpy.test>\r\n",
+		"To: walt@breakingbad.com\r\n",
+		"Subject: =?utf-8?q?Verify_your_email_=E2=9C=93?=\r\n",
+		"@chirpy.test>\r\n",
+		"\r\n\r\nLine one\r\nLine two\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Message missing %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	m := &FileMailer{Dir: t.TempDir(), From: "noreply@chirpy.test"}
+	err := m.Send(context.Background(), Message{To: "a@b.c\r\nBcc: victim@example.com", Subject: "hi"})
+	if !errors.Is(err, ErrHeaderInjection) {
+		t.Errorf("Expected ErrHeaderInjection, got %v", err)
+	}
+}
+
+// fakeSMTP accepts one message and returns what it received on the channel.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 fake ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+			switch cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 fake")
+			case "MAIL", "RCPT":
+				transcript.WriteString(line + "\n")
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				body, _ := io.ReadAll(tp.DotReader())
+				transcript.Write(body)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				got <- transcript.String()
+				return
+			default:
+				tp.PrintfLine("502 unsupported")
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestSMTPMailer(t *testing.T) {
+	for _, from := range []string{"noreply@chirpy.test", "Chirpy <noreply@chirpy.test>"} {
+		addr, got := fakeSMTP(t)
+		m := &SMTPMailer{Addr: addr, From: from}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := m.Send(ctx, Message{To: "walt@breakingbad.com", Subject: "Hello", Body: "Hi Walt"}); err != nil {
+			t.Fatalf("Error sending from %q: %s", from, err)
+		}
+		transcript := <-got
+		for _, want := range []string{"MAIL FROM:<noreply@chirpy.test>", "RCPT TO:<walt@breakingbad.com>", "From: " + from + "\n", "Subject: Hello", "Hi Walt"} {
+			if !strings.Contains(transcript, want) {
+				t.Errorf("Transcript from %q missing %q:\n%s", from, want, transcript)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounterVec("chirpy_test_total", "A test counter.", "route", "status")
+	c.Inc("GET /api/chirps/", "200")
+	c.Inc("GET /api/chirps/", "200")
+	c.Add(3, "POST /api/chirps", "201")
+
+	var sb strings.Builder
+	if _, err := reg.WriteTo(&sb); err != nil {
+		t.Errorf("Error writing metrics: %s", err)
+	}
+	want := `# HELP chirpy_test_total A test counter.
+# TYPE chirpy_test_total counter
+chirpy_test_total{route="GET /api/chirps/",status="200"} 2
+chirpy_test_total{route="POST /api/chirps",status="201"} 3
+`
+	if sb.String() != want {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", sb.String(), want)
+	}
+	if v := c.Value("GET /api/chirps/", "200"); v != 2 {
+		t.Errorf("Expected counter value 2, got %v", v)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.NewHistogramVec("chirpy_test_seconds", "A test histogram.", []float64{1, 0.1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(2, "/a")
+
+	var sb strings.Builder
+	reg.WriteTo(&sb)
+	want := `# HELP chirpy_test_seconds A test histogram.
+# TYPE chirpy_test_seconds histogram
+chirpy_test_seconds_bucket{route="/a",le="0.1"} 1
+chirpy_test_seconds_bucket{route="/a",le="1"} 2
+chirpy_test_seconds_bucket{route="/a",le="+Inf"} 3
+chirpy_test_seconds_sum{route="/a"} 2.55
+chirpy_test_seconds_count{route="/a"} 3
+`
+	if sb.String() != want {
+		t.Errorf("Unexpected exposition:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestFuncMetricsAndEscaping(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewGaugeFunc("chirpy_test_gauge", "Line one\nline \\two", func() float64 { return 7 })
+	c := reg.NewCounterVec("chirpy_test_escape_total", "Escaping.", "value")
+	c.Inc("say \"hi\"\n")
+
+	var sb strings.Builder
+	reg.WriteTo(&sb)
+	out := sb.String()
+	if !strings.Contains(out, `# HELP chirpy_test_gauge Line one\nline \\two`) {
+		t.Errorf("Help text not escaped: %s", out)
+	}
+	if !strings.Contains(out, "chirpy_test_gauge 7\n") {
+		t.Errorf("Gauge value missing: %s", out)
+	}
+	if !strings.Contains(out, `chirpy_test_escape_total{value="say \"hi\"\n"} 1`) {
+		t.Errorf("Label value not escaped: %s", out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounterVec("chirpy_test_total", "A test counter.").Inc()
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "chirpy_test_total 1\n") {
+		t.Errorf("Counter missing from response: %s", body)
+	}
+}
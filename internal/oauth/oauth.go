@@ -0,0 +1,537 @@
+// Package oauth implements a minimal OAuth 2.1 authorization server: the
+// authorization code grant with mandatory PKCE (S256 only), and the refresh
+// token grant. The Server checks requests, asks the user for consent and
+// hands out authorization codes; where clients and codes are kept, and what
+// the tokens it issues look like, is up to its Store and TokenIssuer.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultCodeTTL is how long an authorization code can be exchanged for
+// tokens when Server.CodeTTL is not set.
+const DefaultCodeTTL = time.Minute
+
+var (
+	// ErrNotFound is returned by a Store for unknown clients and codes.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidGrant is returned by a TokenIssuer for refresh tokens that
+	// are unknown, expired, revoked or belong to another client.
+	ErrInvalidGrant = errors.New("invalid grant")
+)
+
+// Client is a registered application.
+type Client struct {
+	ID   string
+	Name string
+	// SecretHash is the HashSecret of the client's secret, or empty for a
+	// public client such as a single-page or native app.
+	SecretHash string
+	// RedirectURIs are compared exactly; there is no prefix matching.
+	RedirectURIs []string
+	// Scopes are the most the client may ask for.
+	Scopes []string
+}
+
+// Public reports whether the client has no secret to authenticate with.
+func (c Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+// Grant is what a user approved on the consent page, and what an
+// authorization code stands for until it is exchanged.
+type Grant struct {
+	ClientID string
+	UserID   uuid.UUID
+	// Scope is the space-separated list of scopes granted.
+	Scope         string
+	RedirectURI   string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// Store keeps clients and outstanding authorization codes.
+type Store interface {
+	// Client returns the client with the given ID, or ErrNotFound.
+	Client(ctx context.Context, id string) (Client, error)
+	// SaveCode keeps the grant an authorization code stands for under the
+	// code's hash.
+	SaveCode(ctx context.Context, codeHash string, g Grant) error
+	// UseCode removes and returns the grant saved under codeHash, or
+	// ErrNotFound, so that each code can be exchanged only once.
+	UseCode(ctx context.Context, codeHash string) (Grant, error)
+}
+
+// Token is a successful token endpoint response. TokenType is filled in by
+// the Server.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// TokenIssuer mints the tokens clients get from the token endpoint.
+type TokenIssuer interface {
+	// IssueToken starts a new session for an exchanged authorization code.
+	IssueToken(ctx context.Context, client Client, g Grant) (Token, error)
+	// RefreshToken exchanges a refresh token issued to client for new
+	// tokens, or returns ErrInvalidGrant.
+	RefreshToken(ctx context.Context, client Client, refreshToken string) (Token, error)
+}
+
+// Error is an OAuth error response, sent as JSON or as query parameters on
+// a redirect back to the client.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Server handles the OAuth endpoints. Its handlers expect to be mounted at
+// /oauth/authorize, /oauth/consent and /oauth/token under Issuer, which is
+// what Metadata advertises.
+type Server struct {
+	// Issuer is the server's base URL, e.g. https://chirpy.example.
+	Issuer string
+	Store  Store
+	Tokens TokenIssuer
+	// Authenticate returns the logged-in user approving a request.
+	Authenticate func(*http.Request) (uuid.UUID, error)
+	// ConsentPage is the page users are sent to with the authorization
+	// request's query string to approve or deny it. It reads the request
+	// from ConsentInfo and posts the user's decision to Consent.
+	ConsentPage string
+	// Scopes are every scope a client may be granted.
+	Scopes  []string
+	CodeTTL time.Duration
+}
+
+// authRequest is an authorization request that has been checked against
+// the client's registration.
+type authRequest struct {
+	client      Client
+	redirectURI string
+	scope       string
+	state       string
+	challenge   string
+}
+
+// parseRequest checks the parameters of an authorization request. Errors
+// found before the redirect URI has been matched must not be sent back to
+// it, so the returned request has an empty redirectURI in that case.
+func (s *Server) parseRequest(ctx context.Context, v url.Values) (authRequest, error) {
+	var ar authRequest
+	client, err := s.Store.Client(ctx, v.Get("client_id"))
+	if errors.Is(err, ErrNotFound) {
+		return ar, &Error{Code: "invalid_request", Description: "unknown client_id"}
+	}
+	if err != nil {
+		return ar, err
+	}
+	ar.client = client
+	redirectURI := v.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return ar, &Error{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+	ar.redirectURI = redirectURI
+	ar.state = v.Get("state")
+
+	if v.Get("response_type") != "code" {
+		return ar, &Error{Code: "unsupported_response_type", Description: "response_type must be code"}
+	}
+	ar.challenge = v.Get("code_challenge")
+	if v.Get("code_challenge_method") != "S256" || !validChallenge(ar.challenge) {
+		return ar, &Error{Code: "invalid_request", Description: "a code_challenge with code_challenge_method S256 is required"}
+	}
+	scopes := strings.Fields(v.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = slices.Clone(client.Scopes)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) || !slices.Contains(s.Scopes, scope) {
+			return ar, &Error{Code: "invalid_scope", Description: "scope " + scope + " is not available to this client"}
+		}
+	}
+	if len(scopes) == 0 {
+		return ar, &Error{Code: "invalid_scope", Description: "no scope requested"}
+	}
+	slices.Sort(scopes)
+	ar.scope = strings.Join(slices.Compact(scopes), " ")
+	return ar, nil
+}
+
+// redirect is the URL that sends the user back to the client with params
+// added to the redirect URI.
+func (s *Server) redirect(ar authRequest, params url.Values) string {
+	u, err := url.Parse(ar.redirectURI)
+	if err != nil {
+		// Registered redirect URIs are checked when the client is created.
+		return ar.redirectURI
+	}
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	if ar.state != "" {
+		q.Set("state", ar.state)
+	}
+	if s.Issuer != "" {
+		// RFC 9207, so clients talking to several servers can tell which
+		// one answered.
+		q.Set("iss", s.Issuer)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func errorParams(oerr *Error) url.Values {
+	params := url.Values{"error": {oerr.Code}}
+	if oerr.Description != "" {
+		params.Set("error_description", oerr.Description)
+	}
+	return params
+}
+
+// Authorize is the authorization endpoint. It checks the request and
+// passes it on to the consent page, or sends the error back to the client
+// if the redirect URI can be trusted with it.
+func (s *Server) Authorize(w http.ResponseWriter, r *http.Request) {
+	ar, err := s.parseRequest(r.Context(), r.URL.Query())
+	var oerr *Error
+	switch {
+	case errors.As(err, &oerr) && ar.redirectURI != "":
+		http.Redirect(w, r, s.redirect(ar, errorParams(oerr)), http.StatusFound)
+	case err != nil:
+		s.writeError(w, r, err)
+	default:
+		http.Redirect(w, r, s.ConsentPage+"?"+r.URL.RawQuery, http.StatusFound)
+	}
+}
+
+// ConsentInfo describes an authorization request for the consent page to
+// show. The client name comes from its registration, not the request, so
+// the page can't be made to show another application's name.
+func (s *Server) ConsentInfo(w http.ResponseWriter, r *http.Request) {
+	ar, err := s.parseRequest(r.Context(), r.URL.Query())
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ClientID    string   `json:"client_id"`
+		ClientName  string   `json:"client_name"`
+		RedirectURI string   `json:"redirect_uri"`
+		Scopes      []string `json:"scopes"`
+	}{
+		ClientID:    ar.client.ID,
+		ClientName:  ar.client.Name,
+		RedirectURI: ar.redirectURI,
+		Scopes:      strings.Fields(ar.scope),
+	})
+}
+
+// Consent takes the logged-in user's decision on an authorization request:
+// the request's parameters as a form, plus decision=approve or
+// decision=deny. It answers with the URL to send the browser to next, since
+// a redirect would be followed by fetch instead of the page.
+func (s *Server) Consent(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.Authenticate(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, &Error{Code: "login_required", Description: "log in to answer this request"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+	ar, err := s.parseRequest(r.Context(), r.PostForm)
+	var oerr *Error
+	if errors.As(err, &oerr) && ar.redirectURI != "" {
+		writeRedirect(w, s.redirect(ar, errorParams(oerr)))
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if r.PostForm.Get("decision") != "approve" {
+		writeRedirect(w, s.redirect(ar, url.Values{"error": {"access_denied"}}))
+		return
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	ttl := s.CodeTTL
+	if ttl <= 0 {
+		ttl = DefaultCodeTTL
+	}
+	err = s.Store.SaveCode(r.Context(), HashSecret(code), Grant{
+		ClientID:      ar.client.ID,
+		UserID:        userID,
+		Scope:         ar.scope,
+		RedirectURI:   ar.redirectURI,
+		CodeChallenge: ar.challenge,
+		ExpiresAt:     time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "OAuth grant approved", "client_id", ar.client.ID, "scope", ar.scope)
+	writeRedirect(w, s.redirect(ar, url.Values{"code": {code}}))
+}
+
+// Token is the token endpoint. Confidential clients authenticate with HTTP
+// Basic or client_secret in the form; public clients send only client_id.
+func (s *Server) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, r, &Error{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+	client, err := s.authenticateClient(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	var token Token
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		token, err = s.exchangeCode(r.Context(), client, r.PostForm)
+	case "refresh_token":
+		refreshToken := r.PostForm.Get("refresh_token")
+		if refreshToken == "" {
+			err = &Error{Code: "invalid_request", Description: "refresh_token is required"}
+			break
+		}
+		token, err = s.Tokens.RefreshToken(r.Context(), client, refreshToken)
+		if errors.Is(err, ErrInvalidGrant) {
+			err = &Error{Code: "invalid_grant", Description: "refresh token is invalid, expired or revoked"}
+		}
+	default:
+		err = &Error{Code: "unsupported_grant_type", Description: "grant_type must be authorization_code or refresh_token"}
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	token.TokenType = "Bearer"
+	writeJSON(w, http.StatusOK, token)
+}
+
+// authenticateClient identifies the client calling the token endpoint.
+func (s *Server) authenticateClient(r *http.Request) (Client, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 has both halves form-encoded before they are joined.
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return Client{}, &Error{Code: "invalid_client", Description: "malformed client credentials"}
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id == "" {
+		return Client{}, &Error{Code: "invalid_client", Description: "client_id is required"}
+	}
+	client, err := s.Store.Client(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		return Client{}, &Error{Code: "invalid_client", Description: "unknown client"}
+	}
+	if err != nil {
+		return Client{}, err
+	}
+	if client.Public() {
+		if secret != "" {
+			return Client{}, &Error{Code: "invalid_client", Description: "public clients have no secret"}
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return Client{}, &Error{Code: "invalid_client", Description: "wrong client secret"}
+	}
+	return client, nil
+}
+
+func (s *Server) exchangeCode(ctx context.Context, client Client, v url.Values) (Token, error) {
+	code, verifier := v.Get("code"), v.Get("code_verifier")
+	if code == "" || verifier == "" {
+		return Token{}, &Error{Code: "invalid_request", Description: "code and code_verifier are required"}
+	}
+	g, err := s.Store.UseCode(ctx, HashSecret(code))
+	if errors.Is(err, ErrNotFound) {
+		return Token{}, &Error{Code: "invalid_grant", Description: "unknown or already used authorization code"}
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if g.ClientID != client.ID {
+		return Token{}, &Error{Code: "invalid_grant", Description: "authorization code was issued to another client"}
+	}
+	if !time.Now().Before(g.ExpiresAt) {
+		return Token{}, &Error{Code: "invalid_grant", Description: "authorization code has expired"}
+	}
+	if redirectURI := v.Get("redirect_uri"); redirectURI != "" && redirectURI != g.RedirectURI {
+		return Token{}, &Error{Code: "invalid_grant", Description: "redirect_uri does not match the authorization request"}
+	}
+	if !validVerifier(verifier) || subtle.ConstantTimeCompare([]byte(S256Challenge(verifier)), []byte(g.CodeChallenge)) != 1 {
+		return Token{}, &Error{Code: "invalid_grant", Description: "code_verifier does not match code_challenge"}
+	}
+	return s.Tokens.IssueToken(ctx, client, g)
+}
+
+// Metadata serves the RFC 8414 authorization server metadata, usually at
+// /.well-known/oauth-authorization-server.
+func (s *Server) Metadata(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+	}{
+		Issuer:                            s.Issuer,
+		AuthorizationEndpoint:             s.Issuer + "/oauth/authorize",
+		TokenEndpoint:                     s.Issuer + "/oauth/token",
+		ScopesSupported:                   s.Scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		AuthorizationResponseIssParameter: s.Issuer != "",
+	})
+}
+
+// writeError sends an OAuth error as JSON. Errors that aren't an *Error are
+// logged and reported as server_error.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var oerr *Error
+	if !errors.As(err, &oerr) {
+		slog.ErrorContext(r.Context(), "OAuth request failed", "error", err)
+		writeJSON(w, http.StatusInternalServerError, &Error{Code: "server_error"})
+		return
+	}
+	status := http.StatusBadRequest
+	if oerr.Code == "invalid_client" {
+		status = http.StatusUnauthorized
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+	}
+	writeJSON(w, status, oerr)
+}
+
+func writeRedirect(w http.ResponseWriter, to string) {
+	writeJSON(w, http.StatusOK, struct {
+		RedirectTo string `json:"redirect_to"`
+	}{
+		RedirectTo: to,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		slog.Debug("error writing response", "error", err)
+	}
+}
+
+// NewClientCredentials returns an ID for a new client and, unless it is
+// public, a secret to give it once. Store only HashSecret of the secret.
+func NewClientCredentials(public bool) (id, secret string, err error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(b)
+	if public {
+		return id, "", nil
+	}
+	secret, err = randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return id, secret, nil
+}
+
+// HashSecret returns the stored form of a client secret or authorization
+// code. Both are random enough that a plain SHA-256 suffices.
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// S256Challenge is the PKCE code_challenge for verifier.
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validChallenge reports whether challenge could be an S256Challenge.
+func validChallenge(challenge string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil && len(b) == sha256.Size
+}
+
+// validVerifier checks a code_verifier against RFC 7636: 43 to 128
+// unreserved characters.
+func validVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,396 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const (
+	testRedirect = "https://client.example/callback"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+type memoryStore struct {
+	mu      sync.Mutex
+	clients map[string]Client
+	codes   map[string]Grant
+}
+
+func (m *memoryStore) Client(ctx context.Context, id string) (Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.clients[id]
+	if !ok {
+		return Client{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *memoryStore) SaveCode(ctx context.Context, codeHash string, g Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[codeHash] = g
+	return nil
+}
+
+func (m *memoryStore) UseCode(ctx context.Context, codeHash string) (Grant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.codes[codeHash]
+	if !ok {
+		return Grant{}, ErrNotFound
+	}
+	delete(m.codes, codeHash)
+	return g, nil
+}
+
+// fakeIssuer hands out the user and scope as the access token and accepts
+// "refresh-<client ID>" as a refresh token.
+type fakeIssuer struct{}
+
+func (fakeIssuer) IssueToken(ctx context.Context, client Client, g Grant) (Token, error) {
+	return Token{AccessToken: g.UserID.String() + " " + g.Scope, ExpiresIn: 3600, RefreshToken: "refresh-" + client.ID, Scope: g.Scope}, nil
+}
+
+func (fakeIssuer) RefreshToken(ctx context.Context, client Client, refreshToken string) (Token, error) {
+	if refreshToken != "refresh-"+client.ID {
+		return Token{}, ErrInvalidGrant
+	}
+	return Token{AccessToken: "refreshed", ExpiresIn: 3600, RefreshToken: refreshToken}, nil
+}
+
+type testServer struct {
+	*httptest.Server
+	user   uuid.UUID
+	public Client
+	secret string
+	conf   Client
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := &testServer{user: uuid.New()}
+	ts.public = Client{ID: "public", Name: "Phone app", RedirectURIs: []string{testRedirect}, Scopes: []string{"profile:write"}}
+	ts.secret = "s3cret"
+	ts.conf = Client{ID: "conf", Name: "Web app", SecretHash: HashSecret(ts.secret), RedirectURIs: []string{testRedirect, testRedirect + "2"}, Scopes: []string{"profile:write"}}
+	store := &memoryStore{
+		clients: map[string]Client{ts.public.ID: ts.public, ts.conf.ID: ts.conf},
+		codes:   map[string]Grant{},
+	}
+	s := &Server{
+		Issuer: "https://chirpy.example",
+		Store:  store,
+		Tokens: fakeIssuer{},
+		Authenticate: func(r *http.Request) (uuid.UUID, error) {
+			if r.Header.Get("Authorization") != "Bearer user" {
+				return uuid.Nil, errors.New("not logged in")
+			}
+			return ts.user, nil
+		},
+		ConsentPage: "/app/consent.html",
+		Scopes:      []string{"chirps:write", "profile:write"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth/authorize", s.Authorize)
+	mux.HandleFunc("GET /oauth/consent", s.ConsentInfo)
+	mux.HandleFunc("POST /oauth/consent", s.Consent)
+	mux.HandleFunc("POST /oauth/token", s.Token)
+	ts.Server = httptest.NewServer(mux)
+	ts.Client().CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func authParams(clientID string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirect},
+		"scope":                 {"profile:write"},
+		"state":                 {"xyz"},
+		"code_challenge":        {S256Challenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// consent posts the user's decision and returns where the consent page
+// would send the browser.
+func (ts *testServer) consent(t *testing.T, params url.Values, decision string) *url.URL {
+	t.Helper()
+	form := url.Values{"decision": {decision}}
+	for k, v := range params {
+		form[k] = v
+	}
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/oauth/consent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer user")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("consent: got status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(body.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func (ts *testServer) token(t *testing.T, form url.Values, basicID, basicSecret string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicID != "" {
+		req.SetBasicAuth(basicID, basicSecret)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("token response Cache-Control = %q", cc)
+	}
+	body := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	ts := newTestServer(t)
+	params := authParams(ts.public.ID)
+
+	resp, err := ts.Client().Get(ts.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || loc.Path != "/app/consent.html" || loc.Query().Get("state") != "xyz" {
+		t.Fatalf("Expected redirect to the consent page with the request, got %d to %s", resp.StatusCode, loc)
+	}
+
+	resp, err = ts.Client().Get(ts.URL + "/oauth/consent?" + loc.RawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		ClientName string   `json:"client_name"`
+		Scopes     []string `json:"scopes"`
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.ClientName != "Phone app" || len(info.Scopes) != 1 || info.Scopes[0] != "profile:write" {
+		t.Errorf("Unexpected consent info %+v", info)
+	}
+
+	back := ts.consent(t, loc.Query(), "approve")
+	q := back.Query()
+	if back.Scheme+"://"+back.Host+back.Path != testRedirect || q.Get("state") != "xyz" || q.Get("iss") != "https://chirpy.example" {
+		t.Fatalf("Unexpected redirect back to client: %s", back)
+	}
+	code := q.Get("code")
+	if code == "" {
+		t.Fatalf("No code in %s", back)
+	}
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirect},
+		"client_id":     {ts.public.ID},
+		"code_verifier": {testVerifier},
+	}
+	status, body := ts.token(t, exchange, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected tokens, got %d %v", status, body)
+	}
+	if body["access_token"] != ts.user.String()+" profile:write" || body["token_type"] != "Bearer" || body["scope"] != "profile:write" {
+		t.Errorf("Unexpected token response %v", body)
+	}
+
+	// Codes work once.
+	if status, body := ts.token(t, exchange, "", ""); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected reused code to be refused, got %d %v", status, body)
+	}
+
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {body["refresh_token"].(string)}, "client_id": {ts.public.ID}}
+	if status, body := ts.token(t, refresh, "", ""); status != http.StatusOK || body["access_token"] != "refreshed" {
+		t.Errorf("Expected refresh to work, got %d %v", status, body)
+	}
+	refresh.Set("refresh_token", "refresh-conf")
+	if status, body := ts.token(t, refresh, "", ""); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected another client's refresh token to be refused, got %d %v", status, body)
+	}
+}
+
+func TestPKCEIsEnforced(t *testing.T) {
+	ts := newTestServer(t)
+	code := ts.consent(t, authParams(ts.public.ID), "approve").Query().Get("code")
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {ts.public.ID},
+		"code_verifier": {strings.Repeat("a", 43)},
+	}
+	if status, body := ts.token(t, exchange, "", ""); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected wrong verifier to be refused, got %d %v", status, body)
+	}
+	// The failed attempt used up the code.
+	exchange.Set("code_verifier", testVerifier)
+	if status, body := ts.token(t, exchange, "", ""); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected code to be spent, got %d %v", status, body)
+	}
+
+	for name, change := range map[string]func(url.Values){
+		"missing challenge": func(v url.Values) { v.Del("code_challenge") },
+		"plain method":      func(v url.Values) { v.Set("code_challenge_method", "plain") },
+		"short challenge":   func(v url.Values) { v.Set("code_challenge", "abc") },
+	} {
+		params := authParams(ts.public.ID)
+		change(params)
+		resp, err := ts.Client().Get(ts.URL + "/oauth/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		loc, _ := url.Parse(resp.Header.Get("Location"))
+		if !strings.HasPrefix(loc.String(), testRedirect) || loc.Query().Get("error") != "invalid_request" || loc.Query().Get("state") != "xyz" {
+			t.Errorf("%s: expected invalid_request sent back to the client, got %s", name, loc)
+		}
+	}
+}
+
+func TestAuthorizeRequestErrors(t *testing.T) {
+	ts := newTestServer(t)
+	for name, tc := range map[string]struct {
+		change   func(url.Values)
+		redirect bool
+		code     string
+	}{
+		"unknown client":        {func(v url.Values) { v.Set("client_id", "nope") }, false, "invalid_request"},
+		"unregistered redirect": {func(v url.Values) { v.Set("redirect_uri", "https://evil.example/") }, false, "invalid_request"},
+		"implicit grant":        {func(v url.Values) { v.Set("response_type", "token") }, true, "unsupported_response_type"},
+		"scope not allowed":     {func(v url.Values) { v.Set("scope", "chirps:write") }, true, "invalid_scope"},
+		"unknown scope":         {func(v url.Values) { v.Set("scope", "admin") }, true, "invalid_scope"},
+	} {
+		params := authParams(ts.public.ID)
+		tc.change(params)
+		resp, err := ts.Client().Get(ts.URL + "/oauth/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := map[string]any{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if tc.redirect {
+			loc, _ := url.Parse(resp.Header.Get("Location"))
+			if resp.StatusCode != http.StatusFound || !strings.HasPrefix(loc.String(), testRedirect) || loc.Query().Get("error") != tc.code {
+				t.Errorf("%s: expected %s sent to the client, got %d to %s", name, tc.code, resp.StatusCode, loc)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Location") != "" || body["error"] != tc.code {
+			t.Errorf("%s: expected %s without a redirect, got %d %v", name, tc.code, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestConsent(t *testing.T) {
+	ts := newTestServer(t)
+
+	denied := ts.consent(t, authParams(ts.public.ID), "deny")
+	if denied.Query().Get("error") != "access_denied" || denied.Query().Get("code") != "" {
+		t.Errorf("Expected access_denied, got %s", denied)
+	}
+
+	form := authParams(ts.public.ID)
+	form.Set("decision", "approve")
+	resp, err := ts.Client().Post(ts.URL+"/oauth/consent", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected consent without a login to be refused, got %d", resp.StatusCode)
+	}
+
+	// Clients with several redirect URIs must say which one to use.
+	params := authParams(ts.conf.ID)
+	params.Del("redirect_uri")
+	resp, err = ts.Client().Get(ts.URL + "/oauth/consent?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected missing redirect_uri to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestConfidentialClient(t *testing.T) {
+	ts := newTestServer(t)
+	code := ts.consent(t, authParams(ts.conf.ID), "approve").Query().Get("code")
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {testVerifier},
+	}
+
+	exchange.Set("client_id", ts.conf.ID)
+	if status, body := ts.token(t, exchange, "", ""); status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Errorf("Expected missing secret to be refused, got %d %v", status, body)
+	}
+	exchange.Del("client_id")
+	if status, body := ts.token(t, exchange, ts.conf.ID, "wrong"); status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Errorf("Expected wrong secret to be refused, got %d %v", status, body)
+	}
+	if status, body := ts.token(t, exchange, ts.public.ID, ""); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("Expected another client's code to be refused, got %d %v", status, body)
+	}
+
+	code = ts.consent(t, authParams(ts.conf.ID), "approve").Query().Get("code")
+	exchange.Set("code", code)
+	if status, body := ts.token(t, exchange, ts.conf.ID, ts.secret); status != http.StatusOK {
+		t.Errorf("Expected tokens with HTTP Basic, got %d %v", status, body)
+	}
+	code = ts.consent(t, authParams(ts.conf.ID), "approve").Query().Get("code")
+	exchange.Set("code", code)
+	exchange.Set("client_id", ts.conf.ID)
+	exchange.Set("client_secret", ts.secret)
+	if status, body := ts.token(t, exchange, "", ""); status != http.StatusOK {
+		t.Errorf("Expected tokens with client_secret_post, got %d %v", status, body)
+	}
+}
+
+func TestS256Challenge(t *testing.T) {
+	// Example from RFC 7636, appendix B.
+	if got := S256Challenge(testVerifier); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("S256Challenge = %q", got)
+	}
+	if !validVerifier(testVerifier) || validVerifier("short") || validVerifier(strings.Repeat("a", 42)+"!") {
+		t.Error("validVerifier disagrees with RFC 7636")
+	}
+}
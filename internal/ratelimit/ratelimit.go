@@ -0,0 +1,178 @@
+// Package ratelimit implements token-bucket rate limiting. Each key gets a
+// bucket of Burst tokens that refills at Rate tokens per second, and every
+// request takes one. Where the buckets live is up to the Store, so several
+// instances can share limits through a database.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit is the size and refill rate of a bucket.
+type Limit struct {
+	// Rate is how many tokens are added per second.
+	Rate float64
+	// Burst is how many tokens the bucket holds, i.e. how many requests
+	// may be made at once after a quiet period.
+	Burst int
+}
+
+// Per allows n requests per d, all of which may be made at once.
+func Per(n int, d time.Duration) Limit {
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}
+}
+
+func (l Limit) duration(tokens float64) time.Duration {
+	if l.Rate <= 0 || tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	Limit   Limit
+	// Remaining is how many whole tokens are left.
+	Remaining int
+	// RetryAfter is how long until a token is available; zero if Allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// SetHeaders writes the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers from the IETF RateLimit header fields draft, plus
+// Retry-After when the request was refused. Times are whole seconds,
+// rounded up.
+func (r Result) SetHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(r.Limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(r.Reset)))
+	if w := r.Limit.duration(float64(r.Limit.Burst)); w > 0 {
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", r.Limit.Burst, seconds(w)))
+	}
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(r.RetryAfter)))
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Bucket is the stored state of one key.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// NewBucket is a full bucket for limit.
+func NewBucket(limit Limit, now time.Time) Bucket {
+	return Bucket{Tokens: float64(limit.Burst), Updated: now}
+}
+
+// Take refills the bucket for the time since it was last updated and then
+// takes a token if there is one.
+func (b *Bucket) Take(limit Limit, now time.Time) Result {
+	if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed*limit.Rate)
+	}
+	b.Updated = now
+
+	result := Result{Limit: limit}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = limit.duration(1 - b.Tokens)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = limit.duration(float64(limit.Burst) - b.Tokens)
+	return result
+}
+
+// full reports whether the bucket would be full by now, so forgetting it
+// changes nothing.
+func (b *Bucket) full(limit Limit, now time.Time) bool {
+	return b.Tokens+now.Sub(b.Updated).Seconds()*limit.Rate >= float64(limit.Burst)
+}
+
+// Store keeps buckets and takes tokens from them atomically.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// MemoryStore keeps buckets in process memory. Limits are per instance.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	limit Limit
+}
+
+// sweepInterval is how often MemoryStore forgets full buckets.
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{Bucket: NewBucket(limit, now)}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	return b.Take(limit, now), nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.full(b.limit, now) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// Limiter applies one Limit to a class of requests, such as a route.
+type Limiter struct {
+	store Store
+	name  string
+	limit Limit
+	now   func() time.Time
+}
+
+// NewLimiter returns a limiter whose buckets are named name plus the key
+// passed to Allow, so limiters can share a store.
+func NewLimiter(store Store, name string, limit Limit) *Limiter {
+	return &Limiter{store: store, name: name, limit: limit, now: time.Now}
+}
+
+// Name is the limiter's name, used to keep its buckets apart from other
+// limiters'.
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Allow takes a token from key's bucket.
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	return l.store.Take(ctx, l.name+":"+key, l.limit, l.now().UTC())
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	limit := Per(3, 3*time.Second)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := NewBucket(limit, start)
+
+	for i := 2; i >= 0; i-- {
+		r := b.Take(limit, start)
+		if !r.Allowed || r.Remaining != i {
+			t.Fatalf("Expected request allowed with %d remaining, got %+v", i, r)
+		}
+	}
+	r := b.Take(limit, start)
+	if r.Allowed {
+		t.Fatalf("Expected empty bucket to refuse, got %+v", r)
+	}
+	if r.RetryAfter != time.Second || r.Reset != 3*time.Second {
+		t.Errorf("Expected retry after 1s and reset after 3s, got %s and %s", r.RetryAfter, r.Reset)
+	}
+
+	// Half a token has refilled; still not enough.
+	if r := b.Take(limit, start.Add(500*time.Millisecond)); r.Allowed || r.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected refusal with 500ms to wait, got %+v", r)
+	}
+	if r := b.Take(limit, start.Add(time.Second)); !r.Allowed || r.Remaining != 0 {
+		t.Errorf("Expected one refilled token, got %+v", r)
+	}
+	// Refill never overflows the burst.
+	if r := b.Take(limit, start.Add(time.Hour)); !r.Allowed || r.Remaining != 2 {
+		t.Errorf("Expected full bucket, got %+v", r)
+	}
+}
+
+func TestMemoryStoreKeysAndSweep(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Per(1, time.Minute)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	if r, _ := s.Take(ctx, "a", limit, now); !r.Allowed {
+		t.Errorf("First request for a should be allowed")
+	}
+	if r, _ := s.Take(ctx, "a", limit, now); r.Allowed {
+		t.Errorf("Second request for a should be refused")
+	}
+	if r, _ := s.Take(ctx, "b", limit, now); !r.Allowed {
+		t.Errorf("Keys should not share a bucket")
+	}
+
+	// Once refilled, buckets are forgotten on the next sweep.
+	s.Take(ctx, "c", limit, now.Add(2*time.Minute))
+	if len(s.buckets) != 1 {
+		t.Errorf("Expected only the new bucket after a sweep, got %d", len(s.buckets))
+	}
+}
+
+func TestLimiterHeaders(t *testing.T) {
+	l := NewLimiter(NewMemoryStore(), "chirps", Per(2, time.Minute))
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	var r Result
+	for range 3 {
+		var err error
+		if r, err = l.Allow(context.Background(), "user"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	h := http.Header{}
+	r.SetHeaders(h)
+	want := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"RateLimit-Policy":    "2;w=60",
+		"Retry-After":         "30",
+	}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("%s: expected %q, got %q", k, v, got)
+		}
+	}
+}
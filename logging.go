@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// redactedKeys are attribute keys whose values must never reach the logs.
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"refresh_token": true,
+}
+
+// newLogger builds the JSON logger used by the whole server. The level is
+// read from LOG_LEVEL (debug, info, warn or error) and defaults to info.
+func newLogger(w io.Writer, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	})
+	return slog.New(contextHandler{handler})
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+// contextHandler adds the request id stored in the context to every record,
+// so handlers only need to use the *Context logging functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	requestInfoKey
+)
+
+// requestInfo is filled in by handlers as they learn things about the
+// request that the access log should report.
+type requestInfo struct {
+	userID uuid.UUID
+}
+
+// setRequestUserID records the authenticated user for the access log.
+func setRequestUserID(ctx context.Context, userID uuid.UUID) {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// middlewareRequestID reuses the caller's X-Request-ID when it looks sane and
+// otherwise generates one, then echoes it back on the response.
+func middlewareRequestID(next http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 || strings.ContainsFunc(id, isUnsafeIDRune) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(req.Context(), requestIDKey, id)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	}
+	return http.HandlerFunc(handler)
+}
+
+func isUnsafeIDRune(r rune) bool {
+	return r < 0x21 || r > 0x7e
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return uuid.NewString()
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// middlewareAccessLog writes one line per request once it has been served.
+func middlewareAccessLog(next http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey, info))
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			attrs := []slog.Attr{
+				slog.String("method", req.Method),
+				// ServeMux fills in Pattern on the request it was handed.
+				slog.String("route", req.Pattern),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", status),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_addr", req.RemoteAddr),
+			}
+			if info.userID != uuid.Nil {
+				attrs = append(attrs, slog.String("user_id", info.userID.String()))
+			}
+			slog.LogAttrs(req.Context(), slog.LevelInfo, "request served", attrs...)
+		}()
+		next.ServeHTTP(rec, req)
+	}
+	return http.HandlerFunc(handler)
+}
@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-
-	// "strings"
+	"os/signal"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/0x4D5352/chirpy/internal/analytics"
 	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/clientip"
 	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/0x4D5352/chirpy/internal/mail"
+	"github.com/0x4D5352/chirpy/internal/ratelimit"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -23,120 +31,291 @@ import (
 func main() {
 	godotenv.Load()
 
-	log.Println("Setting up Database...")
+	logger := newLogger(os.Stdout, os.Getenv("LOG_LEVEL"))
+	slog.SetDefault(logger)
+
+	slog.Info("setting up database")
 	dbURL := os.Getenv("DB_URL")
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("failed to open database", "error", err)
+		os.Exit(1)
 	}
 	dbQueries := database.New(db)
 
-	log.Println("Setting up Server...")
-	apiCfg := apiConfig{
-		db:       dbQueries,
-		platform: os.Getenv("PLATFORM"),
-		secret:   os.Getenv("SECRET"),
+	if len(os.Args) > 1 {
+		code := runCommand(context.Background(), dbQueries, os.Args[1:], os.Stdout, os.Stderr)
+		db.Close()
+		os.Exit(code)
 	}
+
+	slog.Info("loading signing keys")
+	keys, err := loadKeySet(os.Getenv("SECRET"))
+	if err != nil {
+		slog.Error("failed to load signing keys", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("access tokens will be signed", "kid", keys.SigningKeyID())
+
+	mailer, err := newMailer()
+	if err != nil {
+		slog.Error("failed to set up mailer", "error", err)
+		os.Exit(1)
+	}
+
+	passwords, err := newPasswordHasher()
+	if err != nil {
+		slog.Error("failed to set up password hashing", "error", err)
+		os.Exit(1)
+	}
+
+	proxies, err := newClientIPResolver()
+	if err != nil {
+		slog.Error("failed to set up proxy trust", "error", err)
+		os.Exit(1)
+	}
+
+	if os.Getenv("ADMIN_API_KEY") != "" {
+		slog.Warn("ADMIN_API_KEY is no longer used, grant the admin role with grant-admin instead")
+	}
+
+	slog.Info("setting up server")
+	apiCfg := apiConfig{
+		db:                   dbQueries,
+		conn:                 db,
+		platform:             os.Getenv("PLATFORM"),
+		secret:               os.Getenv("SECRET"),
+		keys:                 keys,
+		passwords:            passwords,
+		proxies:              proxies,
+		metrics:              newServerMetrics(db),
+		loginThrottle:        newLoginThrottle(),
+		mailer:               mailer,
+		baseURL:              strings.TrimSuffix(envString("BASE_URL", "http://localhost:"+envString("PORT", "8080")), "/"),
+		requireVerifiedEmail: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		deletionGrace:        envDuration("ACCOUNT_DELETION_GRACE", 0),
+	}
+	apiCfg.pageHits = analytics.NewWriter(apiCfg.flushPageHits, analytics.Options{
+		FlushInterval: envDuration("ANALYTICS_FLUSH_INTERVAL", 5*time.Second),
+	})
+	apiCfg.metrics.registry.NewCounterFunc("chirpy_page_hits_dropped_total",
+		"Page hits dropped because the analytics buffer was full.",
+		func() float64 { return float64(apiCfg.pageHits.Dropped()) })
+	rateLimitStore, err := apiCfg.newRateLimitStore()
+	if err != nil {
+		slog.Error("failed to set up rate limiting", "error", err)
+		os.Exit(1)
+	}
+	limitSignups := apiCfg.middlewareRateLimit(
+		ratelimit.NewLimiter(rateLimitStore, "signups", envRateLimit("RATE_LIMIT_SIGNUPS", ratelimit.Per(5, time.Hour))),
+		apiCfg.rateLimitByIP)
+	limitVerificationEmails := apiCfg.middlewareRateLimit(
+		ratelimit.NewLimiter(rateLimitStore, "verification_emails", envRateLimit("RATE_LIMIT_VERIFICATION_EMAILS", ratelimit.Per(3, time.Hour))),
+		apiCfg.rateLimitByUser)
+	limitPasswordResets := apiCfg.middlewareRateLimit(
+		ratelimit.NewLimiter(rateLimitStore, "password_resets", envRateLimit("RATE_LIMIT_PASSWORD_RESETS", ratelimit.Per(5, time.Hour))),
+		apiCfg.rateLimitByIP)
+	limitChirps := apiCfg.middlewareRateLimit(
+		ratelimit.NewLimiter(rateLimitStore, "chirps", envRateLimit("RATE_LIMIT_CHIRPS", ratelimit.Per(20, time.Minute))),
+		apiCfg.rateLimitByUser)
 	mux := http.NewServeMux()
+	// baseCtx is the parent of every request context. It is only cancelled
+	// once draining has timed out, so long-lived handlers get a chance to
+	// finish on their own first.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 	serv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+		Addr:              ":" + envString("PORT", "8080"),
+		Handler:           middlewareRequestID(middlewareAccessLog(apiCfg.metrics.middlewareMetrics(middlewareRecover(mux)))),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 2*time.Minute),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
-	log.Println("Setting up web app...")
+	oauthServer := apiCfg.newOAuthServer()
+
 	handler := http.StripPrefix("/app/", http.FileServer(http.Dir(".")))
 	mux.Handle("/app/", apiCfg.middlewareMetricsInc(handler))
+	mux.Handle("GET "+oauthConsentPage, apiCfg.middlewareMetricsInc(serveConsentPage(handler)))
 
-	log.Println("Setting up health endpoint...")
 	mux.HandleFunc("GET /api/healthz", checkHealth)
-
-	log.Println("Setting up admin endpoints...")
-	mux.HandleFunc("GET /admin/metrics", apiCfg.checkMetrics)
-	mux.HandleFunc("POST /admin/reset", apiCfg.resetMetrics)
-
-	log.Println("Setting up user endpoints...")
-	mux.HandleFunc("POST /api/users", apiCfg.createUser)
-	mux.HandleFunc("PUT /api/users", apiCfg.updateUser)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.getJWKS)
+	mux.HandleFunc("GET /.well-known/oauth-authorization-server", oauthServer.Metadata)
+	mux.Handle("GET /metrics", apiCfg.metrics.registry.Handler())
+
+	mux.Handle("GET /admin/metrics", apiCfg.middlewareAdmin(http.HandlerFunc(apiCfg.checkMetrics)))
+	mux.Handle("POST /admin/reset", apiCfg.middlewareAdmin(middlewareCSRF(http.HandlerFunc(apiCfg.resetMetrics))))
+	mux.Handle("POST /admin/users/{id}/unlock", apiCfg.middlewareAdmin(middlewareCSRF(http.HandlerFunc(apiCfg.unlockUser))))
+
+	mux.Handle("POST /api/users", limitSignups(http.HandlerFunc(apiCfg.createUser)))
+	mux.Handle("PATCH /api/users", middlewareCSRF(http.HandlerFunc(apiCfg.updateUser)))
+	// PUT predates PATCH and now takes the same partial updates.
+	mux.Handle("PUT /api/users", middlewareCSRF(http.HandlerFunc(apiCfg.updateUser)))
+	mux.Handle("DELETE /api/users", middlewareCSRF(http.HandlerFunc(apiCfg.deleteUser)))
+	mux.HandleFunc("GET /api/users/export", apiCfg.exportUser)
+	mux.HandleFunc("GET /api/users/{handle}", apiCfg.getProfile)
+	mux.HandleFunc("GET /api/users/verify-email", apiCfg.verifyEmail)
+	mux.Handle("POST /api/users/verify-email/resend", limitVerificationEmails(middlewareCSRF(http.HandlerFunc(apiCfg.resendVerificationEmail))))
+	mux.Handle("POST /api/password/forgot", limitPasswordResets(http.HandlerFunc(apiCfg.forgotPassword)))
+	mux.HandleFunc("POST /api/password/reset", apiCfg.resetPassword)
 	mux.HandleFunc("POST /api/login", apiCfg.loginUser)
-	mux.HandleFunc("POST /api/refresh", apiCfg.refreshUserToken)
-	mux.HandleFunc("POST /api/revoke", apiCfg.revokeUserToken)
-
-	log.Println("Setting up chirps endpoint...")
-	mux.HandleFunc("POST /api/chirps", apiCfg.postChirp)
+	mux.HandleFunc("POST /api/login/mfa", apiCfg.verifyMFA)
+	mux.Handle("POST /api/users/totp", middlewareCSRF(http.HandlerFunc(apiCfg.enrollTOTP)))
+	mux.Handle("POST /api/users/totp/confirm", middlewareCSRF(http.HandlerFunc(apiCfg.confirmTOTP)))
+	mux.Handle("DELETE /api/users/totp", middlewareCSRF(http.HandlerFunc(apiCfg.disableTOTP)))
+	mux.Handle("POST /api/refresh", middlewareCSRF(http.HandlerFunc(apiCfg.refreshUserToken)))
+	mux.Handle("POST /api/revoke", middlewareCSRF(http.HandlerFunc(apiCfg.revokeUserToken)))
+	mux.Handle("POST /api/api-keys", middlewareCSRF(http.HandlerFunc(apiCfg.createAPIKey)))
+	mux.HandleFunc("GET /api/api-keys", apiCfg.listAPIKeys)
+	mux.Handle("DELETE /api/api-keys/{id}", middlewareCSRF(http.HandlerFunc(apiCfg.revokeAPIKey)))
+	mux.Handle("POST /api/oauth/clients", middlewareCSRF(http.HandlerFunc(apiCfg.createOAuthClient)))
+	mux.HandleFunc("GET /api/oauth/clients", apiCfg.listOAuthClients)
+	mux.Handle("DELETE /api/oauth/clients/{id}", middlewareCSRF(http.HandlerFunc(apiCfg.deleteOAuthClient)))
+	mux.HandleFunc("GET /oauth/authorize", oauthServer.Authorize)
+	mux.HandleFunc("GET /oauth/consent", oauthServer.ConsentInfo)
+	mux.Handle("POST /oauth/consent", middlewareCSRF(http.HandlerFunc(oauthServer.Consent)))
+	mux.HandleFunc("POST /oauth/token", oauthServer.Token)
+	mux.HandleFunc("GET /api/sessions", apiCfg.listSessions)
+	mux.Handle("DELETE /api/sessions/{id}", middlewareCSRF(http.HandlerFunc(apiCfg.revokeSession)))
+	mux.Handle("POST /api/sessions/revoke-others", middlewareCSRF(http.HandlerFunc(apiCfg.revokeOtherSessions)))
+
+	mux.Handle("POST /api/chirps", limitChirps(middlewareCSRF(http.HandlerFunc(apiCfg.postChirp))))
 	mux.HandleFunc("GET /api/chirps/", apiCfg.getChirps)
 	mux.HandleFunc("GET /api/chirps/{id}", apiCfg.getChirp)
 
-	log.Println("Starting Server...")
-	log.Fatal(serv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	purgeDone := make(chan struct{})
+	go func() {
+		defer close(purgeDone)
+		apiCfg.purgeExpired(ctx)
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", serv.Addr)
+		serveErr <- serv.ListenAndServe()
+	}()
+
+	// failed is set when the server stopped on its own, so main still exits
+	// non-zero once everything has been cleaned up.
+	failed := false
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", "error", err)
+			failed = true
+		}
+	case <-ctx.Done():
+		slog.Info("shutdown signal received, draining requests")
+	}
+	stop()
+
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 20*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := serv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("graceful shutdown failed, closing remaining connections", "error", err)
+		cancelBase()
+		serv.Close()
+	}
+
+	slog.Info("stopping background workers")
+	workerCtx, cancelWorkers := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelWorkers()
+	if err := apiCfg.pageHits.Close(workerCtx); err != nil {
+		slog.Error("error flushing page hits", "error", err)
+	}
+	select {
+	case <-purgeDone:
+	case <-workerCtx.Done():
+		slog.Error("error stopping purge worker", "error", workerCtx.Err())
+	}
+	mailDone := make(chan struct{})
+	go func() {
+		apiCfg.mailSends.Wait()
+		close(mailDone)
+	}()
+	select {
+	case <-mailDone:
+	case <-workerCtx.Done():
+		slog.Error("error waiting for emails to be sent", "error", workerCtx.Err())
+	}
+
+	slog.Info("closing database")
+	if err := db.Close(); err != nil {
+		slog.Error("error closing database", "error", err)
+	}
+	slog.Info("server stopped")
+	if failed {
+		os.Exit(1)
+	}
 }
 
 func checkHealth(w http.ResponseWriter, req *http.Request) {
-	log.Println("Health endpoint hit!")
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	int, err := io.WriteString(w, "OK")
-	if err != nil {
-		log.Fatal(err, int)
-	}
+	respondWithText(w, http.StatusOK, "text/plain; charset=utf-8", "OK")
 }
 
 // TODO: Decide if you should be storing the server in the config or not.
 type apiConfig struct {
-	fileServerHits atomic.Int32
-	db             *database.Queries
-	platform       string
-	secret         string
-}
-
-func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
-	handler := func(w http.ResponseWriter, req *http.Request) {
-		log.Println("Incrementing pagecount...")
-		cfg.fileServerHits.Add(1)
-		next.ServeHTTP(w, req)
-	}
-	return http.HandlerFunc(handler)
-}
-
-func (cfg *apiConfig) checkMetrics(w http.ResponseWriter, req *http.Request) {
-	log.Println("Checking metrics...")
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	body := fmt.Sprintf(`<html>
-  <body>
-    <h1>Welcome, Chirpy Admin</h1>
-    <p>Chirpy has been visited %d times!</p>
-  </body>
-</html>`, cfg.fileServerHits.Load())
-	int, err := io.WriteString(w, body)
-	if err != nil {
-		log.Fatal(err, int)
-	}
+	fileServerHits       atomic.Int32
+	db                   *database.Queries
+	platform             string
+	secret               string
+	keys                 *auth.KeySet
+	passwords            *auth.PasswordHasher
+	conn                 *sql.DB
+	proxies              clientip.Resolver
+	metrics              *serverMetrics
+	pageHits             *analytics.Writer
+	loginThrottle        loginThrottle
+	mailer               mail.Mailer
+	baseURL              string
+	requireVerifiedEmail bool
+	deletionGrace        time.Duration
+	// mailSends tracks emails sent after their response, so shutdown can
+	// wait for them before closing the database.
+	mailSends sync.WaitGroup
 }
 
 func (cfg *apiConfig) resetMetrics(w http.ResponseWriter, req *http.Request) {
 	if cfg.platform != "dev" {
-		log.Println("Unauthorized request to reset endpoint!")
-		log.Printf("%+v", req)
+		slog.WarnContext(req.Context(), "reset attempted outside dev platform", "remote_addr", req.RemoteAddr)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	log.Println("Resetting metrics...")
+	slog.InfoContext(req.Context(), "resetting metrics and database")
 	cfg.fileServerHits.Store(0)
 
-	log.Println("Resetting database...")
 	err := cfg.db.ResetUsers(req.Context())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Fatal(err)
+		respondWithError(w, req, http.StatusInternalServerError, "Error resetting database", err)
+		return
 	}
-
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	int, err := io.WriteString(w, "Metrics reset!")
+	err = cfg.db.ResetPageHits(req.Context())
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error resetting page hits", err)
+		return
+	}
+	err = cfg.db.ResetFailedLogins(req.Context())
 	if err != nil {
-		log.Fatal(err, int)
+		respondWithError(w, req, http.StatusInternalServerError, "Error resetting failed logins", err)
+		return
+	}
+	err = cfg.db.ResetRateLimitBuckets(req.Context())
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error resetting rate limits", err)
+		return
 	}
+
+	respondWithText(w, http.StatusOK, "text/plain; charset=utf-8", "Metrics reset!")
 }
 
 type Chirp struct {
@@ -145,10 +324,10 @@ type Chirp struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	Body      string    `json:"body"`
 	UserID    uuid.UUID `json:"user_id"`
+	Author    Author    `json:"author"`
 }
 
 func (cfg *apiConfig) postChirp(w http.ResponseWriter, req *http.Request) {
-	log.Println("Chirp received!")
 	type reqBody struct {
 		Body string `json:"body"`
 	}
@@ -156,45 +335,30 @@ func (cfg *apiConfig) postChirp(w http.ResponseWriter, req *http.Request) {
 	rb := reqBody{}
 	err := decoder.Decode(&rb)
 	if err != nil {
-		log.Printf("Error decoding body: %s", err)
+		slog.InfoContext(req.Context(), "error decoding body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	type invalidResponse struct {
-		Error string `json:"error"`
-	}
-
-	bearerToken, err := auth.GetBearerToken(req.Header)
+	claims, err := cfg.authenticateScoped(req, auth.ScopeChirpsWrite)
 	if err != nil {
-		log.Printf("Failed to pull token!")
-		log.Printf("Attempted Post: %s", rb.Body)
-		log.Printf("Error: %s", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	userID := claims.UserID
 
-	userID, err := auth.ValidateJWT(bearerToken, cfg.secret)
+	user, err := cfg.db.FindUserByID(req.Context(), userID)
 	if err != nil {
-		log.Printf("Failed to validate token %s", bearerToken)
-		log.Printf("Attempted Post: %s", rb.Body)
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if cfg.requireVerifiedEmail && !user.EmailVerifiedAt.Valid {
+		respondWithError(w, req, http.StatusForbidden, "Verify your email address before posting", nil)
 		return
 	}
 
-	log.Printf("Checking length of post: %s", rb.Body)
 	if len(rb.Body) > 140 {
-		resp, err := json.Marshal(invalidResponse{Error: "Chirp is too long"})
-		log.Println("too long!")
-		if err != nil {
-			log.Printf("Error encoding error: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(resp)
+		respondWithError(w, req, http.StatusBadRequest, "Chirp is too long", nil)
 		return
 	}
 
@@ -213,7 +377,7 @@ func (cfg *apiConfig) postChirp(w http.ResponseWriter, req *http.Request) {
 		UserID: userID,
 	})
 	if err != nil {
-		log.Printf("Error creating Chirp: %s", err)
+		slog.ErrorContext(req.Context(), "error creating chirp", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -224,9 +388,10 @@ func (cfg *apiConfig) postChirp(w http.ResponseWriter, req *http.Request) {
 		UpdatedAt: chirp.UpdatedAt,
 		Body:      chirp.Body,
 		UserID:    chirp.UserID,
+		Author:    authorOf(user),
 	})
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error encoding response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -234,27 +399,38 @@ func (cfg *apiConfig) postChirp(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
-	log.Println("Chirp posted!")
+	cfg.metrics.chirpsCreated.Inc()
+	slog.InfoContext(req.Context(), "chirp posted", "chirp_id", chirp.ID)
 }
 
 func (cfg *apiConfig) getChirp(w http.ResponseWriter, req *http.Request) {
 	chirpID, err := uuid.Parse(req.PathValue("id"))
 	if err != nil {
-		log.Printf("Error parsing ID! %v", err)
+		slog.InfoContext(req.Context(), "error parsing chirp id", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Println("Grabbing chirp!")
 	chirp, err := cfg.db.GetChirp(req.Context(), chirpID)
 	if err != nil {
-		log.Printf("Error getting chirp! %v", err)
+		slog.InfoContext(req.Context(), "error getting chirp", "chirp_id", chirpID, "error", err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	resp, err := json.Marshal(Chirp(chirp))
+	resp, err := json.Marshal(Chirp{
+		ID:        chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		Body:      chirp.Body,
+		UserID:    chirp.UserID,
+		Author: Author{
+			ID:          chirp.UserID,
+			Handle:      chirp.AuthorHandle,
+			DisplayName: chirp.AuthorDisplayName,
+		},
+	})
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error encoding response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -265,21 +441,31 @@ func (cfg *apiConfig) getChirp(w http.ResponseWriter, req *http.Request) {
 }
 
 func (cfg *apiConfig) getChirps(w http.ResponseWriter, req *http.Request) {
-	log.Println("Grabbing all chirps!")
 	chirps, err := cfg.db.GetChirps(req.Context())
 	if err != nil {
-		log.Printf("Error getting chirps! %v", err)
+		slog.ErrorContext(req.Context(), "error getting chirps", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	var respChirps []Chirp
 	for _, chirp := range chirps {
-		respChirps = append(respChirps, Chirp(chirp))
+		respChirps = append(respChirps, Chirp{
+			ID:        chirp.ID,
+			CreatedAt: chirp.CreatedAt,
+			UpdatedAt: chirp.UpdatedAt,
+			Body:      chirp.Body,
+			UserID:    chirp.UserID,
+			Author: Author{
+				ID:          chirp.UserID,
+				Handle:      chirp.AuthorHandle,
+				DisplayName: chirp.AuthorDisplayName,
+			},
+		})
 	}
 
 	resp, err := json.Marshal(respChirps)
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error encoding response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -290,12 +476,32 @@ func (cfg *apiConfig) getChirps(w http.ResponseWriter, req *http.Request) {
 }
 
 type User struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Email        string    `json:"email"`
-	Token        string    `json:"token"`
-	RefreshToken string    `json:"refresh_token"`
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	Handle        string    `json:"handle"`
+	DisplayName   string    `json:"display_name"`
+	Bio           string    `json:"bio"`
+	Role          string    `json:"role"`
+	Token         string    `json:"token,omitempty"`
+	RefreshToken  string    `json:"refresh_token,omitempty"`
+}
+
+// userResponse is user as the API shows it, without tokens.
+func userResponse(user database.User) User {
+	return User{
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt.Valid,
+		Handle:        user.Handle,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		Role:          user.Role,
+	}
 }
 
 type userRequest struct {
@@ -304,20 +510,38 @@ type userRequest struct {
 }
 
 func (cfg *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
-	log.Println("User creation requested!")
 	// TODO: add validation?
 	decoder := json.NewDecoder(req.Body)
-	rb := userRequest{}
+	rb := struct {
+		userRequest
+		Handle      string `json:"handle"`
+		DisplayName string `json:"display_name"`
+	}{}
 	err := decoder.Decode(&rb)
 	if err != nil {
-		log.Printf("Error decoding body: %s", err)
+		slog.InfoContext(req.Context(), "error decoding body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if rb.Handle == "" {
+		rb.Handle, err = generateHandle()
+		if err != nil {
+			respondWithError(w, req, http.StatusInternalServerError, "Error generating handle", err)
+			return
+		}
+	}
+	if msg := checkProfile(&rb.Handle, &rb.DisplayName, nil); msg != "" {
+		respondWithError(w, req, http.StatusBadRequest, msg, nil)
+		return
+	}
 
-	hp, err := auth.HashPassword(rb.Password)
+	hp, err := cfg.passwords.Hash(rb.Password)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		respondWithError(w, req, http.StatusBadRequest, "Password is too long", err)
+		return
+	}
 	if err != nil {
-		log.Printf("Error hashing password: %s", err)
+		slog.ErrorContext(req.Context(), "error hashing password", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -325,22 +549,27 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
 	user, err := cfg.db.CreateUser(req.Context(), database.CreateUserParams{
 		Email:          rb.Email,
 		HashedPassword: hp,
+		Handle:         rb.Handle,
+		DisplayName:    rb.DisplayName,
 	})
+	if isUniqueViolation(err, "users_handle_key") {
+		respondWithError(w, req, http.StatusConflict, "Handle is already taken", err)
+		return
+	}
 	// TODO: send invalid response body
 	if err != nil {
-		log.Printf("Error creating user: %s", err)
+		slog.ErrorContext(req.Context(), "error creating user", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := json.Marshal(User{
-		ID:        user.ID,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-		Email:     user.Email,
-	})
+	if err := cfg.sendVerificationEmail(req.Context(), user); err != nil {
+		slog.ErrorContext(req.Context(), "error sending verification email", "user_id", user.ID, "error", err)
+	}
+
+	resp, err := json.Marshal(userResponse(user))
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error encoding response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -348,232 +577,303 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
-	log.Println("User created!")
+	slog.InfoContext(req.Context(), "user created", "user_id", user.ID)
 }
 
+// userUpdateRequest is the body of PATCH /api/users. Fields left out keep
+// their current value.
+type userUpdateRequest struct {
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+	Handle          *string `json:"handle"`
+	DisplayName     *string `json:"display_name"`
+	Bio             *string `json:"bio"`
+}
+
+// updateUser changes the caller's profile, email and/or password. An access
+// token alone isn't enough to change credentials, so changing those also
+// takes the current password, checked behind the login throttle.
 func (cfg *apiConfig) updateUser(w http.ResponseWriter, req *http.Request) {
-	log.Println("User account update requested!")
-	decoder := json.NewDecoder(req.Body)
-	rb := userRequest{}
-	err := decoder.Decode(&rb)
-	if err != nil {
-		log.Printf("Error decoding body: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	rb := userUpdateRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
 		return
 	}
-
-	bearerToken, err := auth.GetBearerToken(req.Header)
-	if err != nil {
-		log.Printf("Failed to pull token!")
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
+	if rb.Email != nil && *rb.Email == "" {
+		respondWithError(w, req, http.StatusBadRequest, "Email must not be empty", nil)
+		return
+	}
+	if rb.Password != nil && *rb.Password == "" {
+		respondWithError(w, req, http.StatusBadRequest, "Password must not be empty", nil)
+		return
+	}
+	if msg := checkProfile(rb.Handle, rb.DisplayName, rb.Bio); msg != "" {
+		respondWithError(w, req, http.StatusBadRequest, msg, nil)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(bearerToken, cfg.secret)
+	// API keys may edit the profile, but never the credentials.
+	authenticate := func(req *http.Request) (auth.Claims, error) {
+		return cfg.authenticateScoped(req, auth.ScopeProfileWrite)
+	}
+	if rb.Email != nil || rb.Password != nil {
+		authenticate = cfg.authenticate
+	}
+	claims, err := authenticate(req)
 	if err != nil {
-		log.Printf("Failed to validate token %s", bearerToken)
-		log.Printf("Error: %s", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	hp, err := auth.HashPassword(rb.Password)
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
 	if err != nil {
-		log.Printf("Error hashing password: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
 		return
 	}
-
-	err = cfg.db.UpdateUser(req.Context(), database.UpdateUserParams{
-		Email:          rb.Email,
-		HashedPassword: hp,
-		ID:             userID,
-	})
-	// TODO: send invalid response body
-	if err != nil {
-		log.Printf("Error updating user: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	emailChanged := rb.Email != nil && *rb.Email != user.Email
+	passwordChanged := rb.Password != nil
+	credentialsChanged := emailChanged || passwordChanged
+	profileChanged := rb.Handle != nil || rb.DisplayName != nil || rb.Bio != nil
+	if !credentialsChanged && !profileChanged {
+		respondWithJSON(w, http.StatusOK, userResponse(user))
+		return
+	}
+	if credentialsChanged && !cfg.verifyCurrentPassword(w, req, user, rb.CurrentPassword) {
 		return
 	}
 
-	user, err := cfg.db.FindUserByID(req.Context(), userID)
+	handle, displayName, bio := user.Handle, user.DisplayName, user.Bio
+	if rb.Handle != nil {
+		handle = *rb.Handle
+	}
+	if rb.DisplayName != nil {
+		displayName = *rb.DisplayName
+	}
+	if rb.Bio != nil {
+		bio = *rb.Bio
+	}
+	email, hp := user.Email, user.HashedPassword
+	if emailChanged {
+		email = *rb.Email
+	}
+	if passwordChanged {
+		hp, err = cfg.passwords.Hash(*rb.Password)
+		if errors.Is(err, auth.ErrPasswordTooLong) {
+			respondWithError(w, req, http.StatusBadRequest, "Password is too long", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, req, http.StatusInternalServerError, "Error hashing password", err)
+			return
+		}
+	}
 
-	// TODO: move logic to access token function
-	expirationDuration, err := time.ParseDuration("1h")
-	token, err := auth.MakeJWT(user.ID, cfg.secret, expirationDuration)
-	if err != nil {
-		log.Printf("Error creating JWT: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// Changing credentials bumps the user's token version, which invalidates
+	// every access token already handed out, revokes every API key, and logs
+	// out every other session. The caller keeps their session and gets a
+	// fresh access token; its refresh token stays valid. Tokens from before
+	// sessions were tracked can't name the caller's session, so those
+	// callers have to log in again.
+	err = cfg.withTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		if profileChanged {
+			user, err = q.UpdateUserProfile(req.Context(), database.UpdateUserProfileParams{
+				ID:          claims.UserID,
+				Handle:      handle,
+				DisplayName: displayName,
+				Bio:         bio,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !credentialsChanged {
+			return nil
+		}
+		user, err = q.UpdateUser(req.Context(), database.UpdateUserParams{
+			Email:          email,
+			HashedPassword: hp,
+			ID:             claims.UserID,
+		})
+		if err != nil {
+			return err
+		}
+		if passwordChanged {
+			if err := q.DeletePasswordResets(req.Context(), claims.UserID); err != nil {
+				return err
+			}
+		}
+		if err := q.RevokeUserAPIKeys(req.Context(), claims.UserID); err != nil {
+			return err
+		}
+		return q.RevokeOtherSessions(req.Context(), database.RevokeOtherSessionsParams{
+			UserID:   claims.UserID,
+			FamilyID: claims.SessionID,
+		})
+	})
+	if isUniqueViolation(err, "users_handle_key") {
+		respondWithError(w, req, http.StatusConflict, "Handle is already taken", err)
 		return
 	}
-	rawRefreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		log.Printf("Error creating refresh token: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithError(w, req, http.StatusInternalServerError, "Error updating user", err)
 		return
 	}
-	refreshToken, err := cfg.db.CreateRefreshToken(req.Context(), database.CreateRefreshTokenParams{
-		Token:  rawRefreshToken,
-		UserID: user.ID,
+	if !credentialsChanged {
+		respondWithJSON(w, http.StatusOK, userResponse(user))
+		slog.InfoContext(req.Context(), "user profile updated")
+		return
+	}
+
+	token, err := cfg.makeAccessToken(auth.Claims{
+		UserID:       user.ID,
+		SessionID:    claims.SessionID,
+		TokenVersion: user.TokenVersion,
 	})
 	if err != nil {
-		log.Printf("Error adding refresh token to database: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		respondWithError(w, req, http.StatusInternalServerError, "Error creating access token", err)
 		return
 	}
-	resp, err := json.Marshal(User{
-		ID:           user.ID,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
-		Email:        user.Email,
-		Token:        token,
-		RefreshToken: refreshToken.Token,
-	})
+	body := userResponse(user)
+	// The old access token was just invalidated, so a cookie session needs
+	// the replacement in its cookie.
+	if usesCookieSession(req) {
+		setAccessTokenCookie(w, token)
+	} else {
+		body.Token = token
+	}
+	if emailChanged {
+		if err := cfg.sendVerificationEmail(req.Context(), user); err != nil {
+			slog.ErrorContext(req.Context(), "error sending verification email", "error", err)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, body)
+	slog.InfoContext(req.Context(), "user account updated", "email_changed", emailChanged, "password_changed", passwordChanged)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resp)
-	log.Println("User account updated!")
+// verifyCurrentPassword checks password against the user's, counting wrong
+// guesses as failed logins. Unless it matches it writes the response and
+// returns false.
+func (cfg *apiConfig) verifyCurrentPassword(w http.ResponseWriter, req *http.Request, user database.User, password string) bool {
+	attempt, wait, err := cfg.beginLoginAttempt(req.Context(), user.Email, user.ID, cfg.clientIP(req))
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error checking login attempts", err)
+		return false
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		respondWithError(w, req, http.StatusTooManyRequests, "Too many failed login attempts, try again later", nil)
+		return false
+	}
+	if err := cfg.passwords.Check(password, user.HashedPassword); err != nil {
+		respondWithError(w, req, http.StatusForbidden, "Current password is incorrect", nil)
+		return false
+	}
+	cfg.loginAttemptSucceeded(req.Context(), attempt)
+	return true
+}
+
+// loginRequest is a userRequest that may also ask for a cookie session, in
+// which the tokens are set as cookies instead of returned in the body.
+type loginRequest struct {
+	userRequest
+	CookieSession bool `json:"cookie_session"`
 }
 
 func (cfg *apiConfig) loginUser(w http.ResponseWriter, req *http.Request) {
-	log.Println("User login requested!")
 	decoder := json.NewDecoder(req.Body)
-	rb := userRequest{}
+	rb := loginRequest{}
 	err := decoder.Decode(&rb)
 	if err != nil {
-		log.Printf("Error decoding body: %s", err)
+		slog.InfoContext(req.Context(), "error decoding body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	user, err := cfg.db.FindUserByEmail(req.Context(), rb.Email)
+	ip := cfg.clientIP(req)
+	user, lookupErr := cfg.db.FindUserByEmail(req.Context(), rb.Email)
+	attempt, wait, err := cfg.beginLoginAttempt(req.Context(), rb.Email, user.ID, ip)
 	if err != nil {
-		log.Printf("Error finding user: %s", err)
+		respondWithError(w, req, http.StatusInternalServerError, "Error checking login attempts", err)
+		return
+	}
+	if wait > 0 {
+		cfg.metrics.logins.Inc(resultThrottled)
+		slog.WarnContext(req.Context(), "login throttled", "ip", ip, "retry_after", wait)
+		setRetryAfter(w, wait)
+		respondWithError(w, req, http.StatusTooManyRequests, "Too many failed login attempts, try again later", nil)
+		return
+	}
+	if lookupErr != nil {
+		cfg.metrics.logins.Inc(resultFailure)
+		slog.InfoContext(req.Context(), "login failed: unknown email", "error", lookupErr)
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusUnauthorized)
 		_, _ = io.WriteString(w, "Incorrect email or password.")
 		return
 	}
-	if err = auth.CheckPasswordHash(rb.Password, user.HashedPassword); err != nil {
-		log.Printf("Password Check Failed: %s", err)
+	if err = cfg.passwords.Check(rb.Password, user.HashedPassword); err != nil {
+		cfg.metrics.logins.Inc(resultFailure)
+		slog.InfoContext(req.Context(), "login failed: wrong password", "user_id", user.ID)
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusUnauthorized)
 		_, _ = io.WriteString(w, "Incorrect email or password.")
 		return
 	}
-	// TODO: move logic to access token function
-	expirationDuration, err := time.ParseDuration("1h")
-	token, err := auth.MakeJWT(user.ID, cfg.secret, expirationDuration)
-	if err != nil {
-		log.Printf("Error creating JWT: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	cfg.loginAttemptSucceeded(req.Context(), attempt)
+	cfg.upgradePasswordHash(req.Context(), user, rb.Password)
+	if user.TotpEnabled {
+		cfg.sendMFAChallenge(w, req, user)
 		return
 	}
-	rawRefreshToken, err := auth.MakeRefreshToken()
-	if err != nil {
-		log.Printf("Error creating refresh token: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	refreshToken, err := cfg.db.CreateRefreshToken(req.Context(), database.CreateRefreshTokenParams{
-		Token:  rawRefreshToken,
-		UserID: user.ID,
+	cfg.startSession(w, req, user, rb.CookieSession)
+}
+
+// startSession finishes a successful login: it clears the account's failed
+// attempts and issues an access token and a refresh token for a new session,
+// as cookies if the client asked for a cookie session.
+func (cfg *apiConfig) startSession(w http.ResponseWriter, req *http.Request, user database.User, cookieSession bool) {
+	if err := cfg.db.ClearFailedLogins(req.Context(), user.Email); err != nil {
+		slog.ErrorContext(req.Context(), "error clearing failed logins", "error", err)
+	}
+	cfg.cancelAccountDeletion(req.Context(), user)
+	sessionID := uuid.New()
+	token, err := cfg.makeAccessToken(auth.Claims{
+		UserID:       user.ID,
+		SessionID:    sessionID,
+		TokenVersion: user.TokenVersion,
 	})
 	if err != nil {
-		log.Printf("Error adding refresh token to database: %s", err)
+		slog.ErrorContext(req.Context(), "error creating JWT", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resp, err := json.Marshal(User{
-		ID:           user.ID,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
-		Email:        user.Email,
-		Token:        token,
-		RefreshToken: refreshToken.Token,
-	})
+	refreshToken, err := issueRefreshToken(req.Context(), cfg.db, refreshFamily{userID: user.ID, id: sessionID}, cfg.clientInfo(req))
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error storing refresh token", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resp)
-	log.Println("User successfully logged in!")
-
-}
-
-func (cfg *apiConfig) refreshUserToken(w http.ResponseWriter, req *http.Request) {
-	log.Println("Token Refresh Requested!")
-	bearerToken, err := auth.GetBearerToken(req.Header)
-	if err != nil {
-		log.Printf("Failed to pull token!")
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	refreshToken, err := cfg.db.GetRefreshToken(req.Context(), bearerToken)
-	if err != nil {
-		log.Printf("Refresh Failed: Unable to get refresh token!")
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	if time.Until(refreshToken.ExpiresAt) <= 0 {
-		log.Printf("Refresh Failed: Token expired!")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	if refreshToken.RevokedAt.Valid == true {
-		log.Printf("Refresh Failed: Token revoked!")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	expirationDuration, err := time.ParseDuration("1h")
-	token, err := auth.MakeJWT(refreshToken.UserID, cfg.secret, expirationDuration)
-	if err != nil {
-		log.Printf("Error creating JWT: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	body := userResponse(user)
+	body.Token, body.RefreshToken = token, refreshToken
+	if cookieSession {
+		if err := setSessionCookies(w, token, refreshToken); err != nil {
+			slog.ErrorContext(req.Context(), "error creating CSRF token", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body.Token, body.RefreshToken = "", ""
 	}
-	resp, err := json.Marshal(struct {
-		Token string `json:"token"`
-	}{
-		Token: token,
-	})
+	resp, err := json.Marshal(body)
 	if err != nil {
-		log.Printf("Error encoding response: %s", err)
+		slog.ErrorContext(req.Context(), "error encoding response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(resp)
-	log.Println("New Token Issued!")
-}
-
-func (cfg *apiConfig) revokeUserToken(w http.ResponseWriter, req *http.Request) {
-	log.Println("Token Revocation Requested!")
-	bearerToken, err := auth.GetBearerToken(req.Header)
-	if err != nil {
-		log.Printf("Failed to pull token!")
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	err = cfg.db.RevokeToken(req.Context(), bearerToken)
-	if err != nil {
-		log.Printf("Failed to revoke token!")
-		log.Printf("Error: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	w.WriteHeader(http.StatusNoContent)
-	log.Println("Token Revoked!")
+	cfg.metrics.logins.Inc(resultSuccess)
+	setRequestUserID(req.Context(), user.ID)
+	slog.InfoContext(req.Context(), "user logged in")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/metrics"
+)
+
+// serverMetrics are the application metrics exposed on GET /metrics.
+type serverMetrics struct {
+	registry       *metrics.Registry
+	requests       *metrics.CounterVec
+	latency        *metrics.HistogramVec
+	chirpsCreated  *metrics.CounterVec
+	logins         *metrics.CounterVec
+	tokenRefreshes *metrics.CounterVec
+	rateLimited    *metrics.CounterVec
+}
+
+func newServerMetrics(db *sql.DB) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: reg,
+		requests: reg.NewCounterVec("chirpy_http_requests_total",
+			"HTTP requests served, by route pattern and status code.", "route", "status"),
+		latency: reg.NewHistogramVec("chirpy_http_request_duration_seconds",
+			"HTTP request latency, by route pattern and status code.", metrics.DefBuckets, "route", "status"),
+		chirpsCreated: reg.NewCounterVec("chirpy_chirps_created_total",
+			"Chirps successfully created."),
+		logins: reg.NewCounterVec("chirpy_logins_total",
+			"Login attempts, by result (success, failure, throttled or mfa_required).", "result"),
+		tokenRefreshes: reg.NewCounterVec("chirpy_token_refreshes_total",
+			"Access token refresh attempts, by result (success or failure).", "result"),
+		rateLimited: reg.NewCounterVec("chirpy_rate_limited_total",
+			"Requests refused by a rate limiter, by limiter.", "limiter"),
+	}
+
+	if db != nil {
+		reg.NewGaugeFunc("chirpy_db_max_open_connections", "Maximum number of open connections to the database.",
+			func() float64 { return float64(db.Stats().MaxOpenConnections) })
+		reg.NewGaugeFunc("chirpy_db_open_connections", "Established connections, both in use and idle.",
+			func() float64 { return float64(db.Stats().OpenConnections) })
+		reg.NewGaugeFunc("chirpy_db_in_use_connections", "Connections currently in use.",
+			func() float64 { return float64(db.Stats().InUse) })
+		reg.NewGaugeFunc("chirpy_db_idle_connections", "Idle connections.",
+			func() float64 { return float64(db.Stats().Idle) })
+		reg.NewCounterFunc("chirpy_db_wait_count_total", "Connections waited for.",
+			func() float64 { return float64(db.Stats().WaitCount) })
+		reg.NewCounterFunc("chirpy_db_wait_duration_seconds_total", "Time spent waiting for a connection.",
+			func() float64 { return db.Stats().WaitDuration.Seconds() })
+	}
+	return m
+}
+
+const (
+	resultSuccess     = "success"
+	resultFailure     = "failure"
+	resultThrottled   = "throttled"
+	resultMFARequired = "mfa_required"
+)
+
+// middlewareMetrics records request counts and latencies. The route label is
+// the ServeMux pattern rather than the raw path so that ids in URLs do not
+// create unbounded series.
+func (m *serverMetrics) middlewareMetrics(next http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		code := strconv.Itoa(status)
+		m.requests.Inc(route, code)
+		m.latency.Observe(time.Since(start).Seconds(), route, code)
+	}
+	return http.HandlerFunc(handler)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// Accounts with TOTP enabled log in in two steps. POST /api/login checks the
+// password and answers with a short-lived MFA challenge token instead of a
+// session; POST /api/login/mfa exchanges that token and a code from the
+// authenticator app (or a recovery code) for the session.
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+func (cfg *apiConfig) sendMFAChallenge(w http.ResponseWriter, req *http.Request, user database.User) {
+	challenge, err := cfg.keys.MakeMFAChallenge(auth.Claims{
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+	}, mfaChallengeTTL)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error creating MFA challenge", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, mfaChallengeResponse{MFARequired: true, MFAToken: challenge})
+	cfg.metrics.logins.Inc(resultMFARequired)
+	setRequestUserID(req.Context(), user.ID)
+	slog.InfoContext(req.Context(), "password accepted, second factor required")
+}
+
+// checkSecondFactor reports whether code is the user's current TOTP code or
+// one of their unused recovery codes, using it up either way.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, user database.User, code string) (bool, error) {
+	if !user.TotpEnabled || !user.TotpSecret.Valid {
+		return false, nil
+	}
+	if step, ok := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now()); ok {
+		// Only a step later than the last one used counts, so an observed
+		// code can't be replayed while it is still valid.
+		n, err := cfg.db.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			ID:           user.ID,
+			TotpLastStep: step,
+		})
+		return n == 1, err
+	}
+	n, err := cfg.db.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+		UserID:   user.ID,
+		CodeHash: auth.HashRecoveryCode(code),
+	})
+	return n == 1, err
+}
+
+func (cfg *apiConfig) verifyMFA(w http.ResponseWriter, req *http.Request) {
+	rb := struct {
+		MFAToken      string `json:"mfa_token"`
+		Code          string `json:"code"`
+		CookieSession bool   `json:"cookie_session"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	currentVersion := func(userID uuid.UUID) (int32, error) {
+		return cfg.db.GetUserTokenVersion(req.Context(), userID)
+	}
+	claims, err := cfg.keys.ParseMFAChallenge(rb.MFAToken, currentVersion)
+	if err != nil {
+		respondWithError(w, req, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+		return
+	}
+	setRequestUserID(req.Context(), claims.UserID)
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+		return
+	}
+
+	if !cfg.verifySecondFactor(w, req, user, rb.Code, http.StatusUnauthorized) {
+		return
+	}
+	cfg.startSession(w, req, user, rb.CookieSession)
+}
+
+// verifySecondFactor is checkSecondFactor behind the login throttle: codes
+// are only six digits, so wrong ones count as failed logins. Unless the code
+// is accepted it writes the response, using failStatus for a wrong code,
+// and returns false.
+func (cfg *apiConfig) verifySecondFactor(w http.ResponseWriter, req *http.Request, user database.User, code string, failStatus int) bool {
+	attempt, wait, err := cfg.beginLoginAttempt(req.Context(), user.Email, user.ID, cfg.clientIP(req))
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error checking login attempts", err)
+		return false
+	}
+	if wait > 0 {
+		cfg.metrics.logins.Inc(resultThrottled)
+		setRetryAfter(w, wait)
+		respondWithError(w, req, http.StatusTooManyRequests, "Too many failed login attempts, try again later", nil)
+		return false
+	}
+	ok, err := cfg.checkSecondFactor(req.Context(), user, code)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error checking two-factor code", err)
+		return false
+	}
+	if !ok {
+		cfg.metrics.logins.Inc(resultFailure)
+		respondWithError(w, req, failStatus, "Invalid two-factor code", nil)
+		return false
+	}
+	cfg.loginAttemptSucceeded(req.Context(), attempt)
+	return true
+}
+
+// enrollTOTP starts TOTP enrollment with a new secret. It only takes effect
+// once confirmTOTP has seen a code generated from it. Both take the current
+// password, so a stolen access token alone can't lock the owner out behind
+// a second factor they don't have.
+func (cfg *apiConfig) enrollTOTP(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		CurrentPassword string `json:"current_password"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if user.TotpEnabled {
+		respondWithError(w, req, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if !cfg.verifyCurrentPassword(w, req, user, rb.CurrentPassword) {
+		return
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error generating TOTP secret", err)
+		return
+	}
+	err = cfg.db.SetUserTOTPSecret(req.Context(), database.SetUserTOTPSecretParams{
+		ID:         user.ID,
+		TotpSecret: sql.NullString{String: secret, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error saving TOTP secret", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(secret, envString("TOTP_ISSUER", "Chirpy"), user.Email),
+	})
+	slog.InfoContext(req.Context(), "TOTP enrollment started")
+}
+
+// confirmTOTP enables TOTP once the user proves their app is set up, and
+// hands out the recovery codes. They are only ever shown here.
+func (cfg *apiConfig) confirmTOTP(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		Code            string `json:"code"`
+		CurrentPassword string `json:"current_password"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if user.TotpEnabled {
+		respondWithError(w, req, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if !user.TotpSecret.Valid {
+		respondWithError(w, req, http.StatusBadRequest, "Two-factor enrollment has not been started", nil)
+		return
+	}
+	if !cfg.verifyCurrentPassword(w, req, user, rb.CurrentPassword) {
+		return
+	}
+	step, ok := auth.ValidateTOTP(user.TotpSecret.String, rb.Code, time.Now())
+	if !ok {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid two-factor code", nil)
+		return
+	}
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error generating recovery codes", err)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	err = cfg.withTx(req.Context(), func(q *database.Queries) error {
+		err := q.EnableUserTOTP(req.Context(), database.EnableUserTOTPParams{
+			ID:           user.ID,
+			TotpLastStep: step,
+		})
+		if err != nil {
+			return err
+		}
+		if err := q.DeleteRecoveryCodes(req.Context(), user.ID); err != nil {
+			return err
+		}
+		return q.CreateRecoveryCodes(req.Context(), database.CreateRecoveryCodesParams{
+			CodeHashes: hashes,
+			UserID:     user.ID,
+		})
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error enabling two-factor authentication", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	})
+	slog.InfoContext(req.Context(), "TOTP enabled")
+}
+
+// disableTOTP turns TOTP off. It takes a current code or recovery code, so a
+// stolen access token alone can't strip the second factor.
+func (cfg *apiConfig) disableTOTP(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if !user.TotpEnabled {
+		respondWithError(w, req, http.StatusConflict, "Two-factor authentication is not enabled", nil)
+		return
+	}
+	if !cfg.verifySecondFactor(w, req, user, rb.Code, http.StatusBadRequest) {
+		return
+	}
+	err = cfg.withTx(req.Context(), func(q *database.Queries) error {
+		if err := q.DisableUserTOTP(req.Context(), user.ID); err != nil {
+			return err
+		}
+		return q.DeleteRecoveryCodes(req.Context(), user.ID)
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error disabling two-factor authentication", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "TOTP disabled")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// middlewareRecover turns a panicking handler into a 500 for that request
+// instead of letting it take down the whole server.
+func middlewareRecover(next http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// net/http uses this sentinel to abort a response on purpose.
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			slog.ErrorContext(req.Context(), "recovered from panic",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"panic", rec,
+				"stack", string(debug.Stack()),
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, req)
+	}
+	return http.HandlerFunc(handler)
+}
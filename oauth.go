@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/0x4D5352/chirpy/internal/oauth"
+	"github.com/google/uuid"
+)
+
+// Chirpy is its own OAuth 2.1 provider, so third-party apps can act for a
+// user without ever seeing their password. Users register clients under
+// /api/oauth/clients; the flow itself lives in internal/oauth. A grant
+// becomes an ordinary session whose tokens carry the granted scope, so it
+// shows up in /api/sessions and can be revoked there.
+
+const (
+	oauthConsentPage          = "/app/consent.html"
+	maxOAuthClientNameLength  = 100
+	maxOAuthRedirectURIs      = 10
+	maxOAuthRedirectURILength = 2000
+)
+
+// OAuthClient is a registered OAuth client as its owner sees it.
+// ClientSecret is only ever filled in when the client is created.
+type OAuthClient struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+}
+
+func oauthClientResponse(client database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ClientID:     client.ID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectUris,
+		Scopes:       client.Scopes,
+		Public:       !client.SecretHash.Valid,
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+func (cfg *apiConfig) newOAuthServer() *oauth.Server {
+	return &oauth.Server{
+		Issuer: cfg.baseURL,
+		Store:  pgOAuthStore{db: cfg.db},
+		Tokens: oauthTokens{cfg: cfg},
+		Authenticate: func(req *http.Request) (uuid.UUID, error) {
+			claims, err := cfg.authenticate(req)
+			return claims.UserID, err
+		},
+		ConsentPage: oauthConsentPage,
+		Scopes:      auth.Scopes(),
+	}
+}
+
+// pgOAuthStore keeps OAuth clients and authorization codes in Postgres.
+type pgOAuthStore struct {
+	db *database.Queries
+}
+
+func (s pgOAuthStore) Client(ctx context.Context, id string) (oauth.Client, error) {
+	client, err := s.db.GetOAuthClient(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return oauth.Client{}, oauth.ErrNotFound
+	}
+	if err != nil {
+		return oauth.Client{}, err
+	}
+	return oauth.Client{
+		ID:           client.ID,
+		Name:         client.Name,
+		SecretHash:   client.SecretHash.String,
+		RedirectURIs: client.RedirectUris,
+		Scopes:       client.Scopes,
+	}, nil
+}
+
+func (s pgOAuthStore) SaveCode(ctx context.Context, codeHash string, g oauth.Grant) error {
+	// Codes nobody came back for are cleared out here rather than by a
+	// ticker; there are only ever a few.
+	if err := s.db.DeleteExpiredOAuthCodes(ctx, time.Now().UTC()); err != nil {
+		slog.WarnContext(ctx, "error deleting expired OAuth codes", "error", err)
+	}
+	return s.db.CreateOAuthCode(ctx, database.CreateOAuthCodeParams{
+		CodeHash:      codeHash,
+		ClientID:      g.ClientID,
+		UserID:        g.UserID,
+		RedirectUri:   g.RedirectURI,
+		Scope:         g.Scope,
+		CodeChallenge: g.CodeChallenge,
+		ExpiresAt:     g.ExpiresAt,
+	})
+}
+
+func (s pgOAuthStore) UseCode(ctx context.Context, codeHash string) (oauth.Grant, error) {
+	code, err := s.db.UseOAuthCode(ctx, codeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return oauth.Grant{}, oauth.ErrNotFound
+	}
+	if err != nil {
+		return oauth.Grant{}, err
+	}
+	return oauth.Grant{
+		ClientID:      code.ClientID,
+		UserID:        code.UserID,
+		Scope:         code.Scope,
+		RedirectURI:   code.RedirectUri,
+		CodeChallenge: code.CodeChallenge,
+		ExpiresAt:     code.ExpiresAt,
+	}, nil
+}
+
+// oauthTokens issues clients the same access and refresh tokens users get
+// from logging in, limited to the granted scope.
+type oauthTokens struct {
+	cfg *apiConfig
+}
+
+func (t oauthTokens) IssueToken(ctx context.Context, client oauth.Client, g oauth.Grant) (oauth.Token, error) {
+	family := refreshFamily{
+		userID:   g.UserID,
+		id:       uuid.New(),
+		clientID: sql.NullString{String: client.ID, Valid: true},
+		scope:    g.Scope,
+	}
+	var refreshToken string
+	var tokenVersion int32
+	err := t.cfg.withTx(ctx, func(q *database.Queries) error {
+		var err error
+		tokenVersion, err = q.GetUserTokenVersion(ctx, g.UserID)
+		if err != nil {
+			return err
+		}
+		refreshToken, err = issueRefreshToken(ctx, q, family, clientInfo{userAgent: client.Name})
+		return err
+	})
+	if err != nil {
+		return oauth.Token{}, err
+	}
+	slog.InfoContext(ctx, "OAuth tokens issued", "client_id", client.ID, "user_id", g.UserID, "scope", g.Scope)
+	return t.token(family, tokenVersion, refreshToken)
+}
+
+func (t oauthTokens) RefreshToken(ctx context.Context, client oauth.Client, raw string) (oauth.Token, error) {
+	refreshToken, next, err := t.cfg.rotateRefreshToken(ctx, raw, client.ID, clientInfo{userAgent: client.Name})
+	if isRefreshTokenError(err) {
+		slog.InfoContext(ctx, "OAuth refresh failed", "client_id", client.ID, "error", err)
+		return oauth.Token{}, oauth.ErrInvalidGrant
+	}
+	if err != nil {
+		return oauth.Token{}, err
+	}
+	tokenVersion, err := t.cfg.db.GetUserTokenVersion(ctx, refreshToken.UserID)
+	if err != nil {
+		return oauth.Token{}, err
+	}
+	return t.token(familyOf(refreshToken), tokenVersion, next)
+}
+
+func (t oauthTokens) token(family refreshFamily, tokenVersion int32, refreshToken string) (oauth.Token, error) {
+	accessToken, err := t.cfg.makeAccessToken(auth.Claims{
+		UserID:       family.userID,
+		SessionID:    family.id,
+		TokenVersion: tokenVersion,
+		Scope:        family.scope,
+	})
+	if err != nil {
+		return oauth.Token{}, err
+	}
+	return oauth.Token{
+		AccessToken:  accessToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        family.scope,
+	}, nil
+}
+
+// validRedirectURI allows what OAuth 2.1 does: https URLs, http only on the
+// loopback interface, and private-use schemes like com.example.app for
+// native apps. Fragments are never allowed.
+func validRedirectURI(raw string) bool {
+	if len(raw) > maxOAuthRedirectURILength {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return strings.Contains(u.Scheme, ".")
+	}
+}
+
+func (cfg *apiConfig) createOAuthClient(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rb := struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	if rb.Name == "" || len(rb.Name) > maxOAuthClientNameLength {
+		respondWithError(w, req, http.StatusBadRequest, "Name must be 1 to 100 characters", nil)
+		return
+	}
+	if len(rb.RedirectURIs) == 0 || len(rb.RedirectURIs) > maxOAuthRedirectURIs {
+		respondWithError(w, req, http.StatusBadRequest, "Between 1 and 10 redirect URIs are required", nil)
+		return
+	}
+	for _, uri := range rb.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithError(w, req, http.StatusBadRequest, "Invalid redirect URI "+uri, nil)
+			return
+		}
+	}
+	if len(rb.Scopes) == 0 {
+		respondWithError(w, req, http.StatusBadRequest, "At least one scope is required", nil)
+		return
+	}
+	for _, scope := range rb.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, req, http.StatusBadRequest, "Unknown scope "+scope, nil)
+			return
+		}
+	}
+	slices.Sort(rb.Scopes)
+	rb.Scopes = slices.Compact(rb.Scopes)
+
+	id, secret, err := oauth.NewClientCredentials(rb.Public)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error generating client credentials", err)
+		return
+	}
+	var secretHash sql.NullString
+	if secret != "" {
+		secretHash = sql.NullString{String: oauth.HashSecret(secret), Valid: true}
+	}
+	client, err := cfg.db.CreateOAuthClient(req.Context(), database.CreateOAuthClientParams{
+		ID:           id,
+		OwnerID:      claims.UserID,
+		Name:         rb.Name,
+		SecretHash:   secretHash,
+		RedirectUris: rb.RedirectURIs,
+		Scopes:       rb.Scopes,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error creating OAuth client", err)
+		return
+	}
+	body := oauthClientResponse(client)
+	body.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, body)
+	slog.InfoContext(req.Context(), "OAuth client registered", "client_id", client.ID, "public", rb.Public)
+}
+
+func (cfg *apiConfig) listOAuthClients(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	clients, err := cfg.db.ListOAuthClients(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error listing OAuth clients", err)
+		return
+	}
+	body := make([]OAuthClient, 0, len(clients))
+	for _, client := range clients {
+		body = append(body, oauthClientResponse(client))
+	}
+	respondWithJSON(w, http.StatusOK, body)
+}
+
+// deleteOAuthClient removes a client along with every refresh token and
+// authorization code issued to it. Its access tokens run out on their own
+// within accessTokenTTL.
+func (cfg *apiConfig) deleteOAuthClient(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	clientID := req.PathValue("id")
+	n, err := cfg.db.DeleteOAuthClient(req.Context(), database.DeleteOAuthClientParams{
+		ID:      clientID,
+		OwnerID: claims.UserID,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error deleting OAuth client", err)
+		return
+	}
+	if n == 0 {
+		respondWithError(w, req, http.StatusNotFound, "OAuth client not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "OAuth client deleted", "client_id", clientID)
+}
+
+// serveConsentPage serves the consent page from the file server, refusing
+// to let other sites frame it so they can't trick a click on Allow.
+func serveConsentPage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, req)
+	})
+}
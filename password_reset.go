@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/0x4D5352/chirpy/internal/mail"
+)
+
+// A forgotten password is replaced in two steps. POST /api/password/forgot
+// emails a single-use reset token; POST /api/password/reset takes the token
+// and a new password and signs the account out everywhere. Reset tokens are
+// random like refresh tokens and likewise only stored hashed.
+
+const passwordResetTTL = time.Hour
+
+// forgotPassword always answers 202, and does the lookup and mailing after
+// the response has gone out, so neither the status nor the timing tells the
+// caller whether an account uses the address.
+func (cfg *apiConfig) forgotPassword(w http.ResponseWriter, req *http.Request) {
+	rb := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	ctx := context.WithoutCancel(req.Context())
+	cfg.mailSends.Add(1)
+	go func() {
+		defer cfg.mailSends.Done()
+		ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+		defer cancel()
+		if err := cfg.sendPasswordReset(ctx, rb.Email); err != nil {
+			slog.ErrorContext(ctx, "error sending password reset email", "error", err)
+		}
+	}()
+}
+
+// sendPasswordReset mails a reset token to the account using email, if there
+// is one.
+func (cfg *apiConfig) sendPasswordReset(ctx context.Context, email string) error {
+	user, err := cfg.db.FindUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.InfoContext(ctx, "password reset requested for unknown email")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+	err = cfg.db.CreatePasswordReset(ctx, database.CreatePasswordResetParams{
+		TokenHash: auth.HashRefreshToken(token),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+	err = cfg.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account. To choose a new one, "+
+			"send this token along with the new password to %s:\n\n%s\n\n"+
+			"The token works once and expires in %d minutes. If you didn't ask for this, you can ignore this email; "+
+			"your password has not changed.\n",
+			cfg.baseURL+"/api/password/reset", token, int(passwordResetTTL.Minutes())),
+	})
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "password reset email sent", "user_id", user.ID)
+	return nil
+}
+
+// resetPassword sets a new password for the holder of a reset token. It
+// bumps the token version and revokes every refresh token and API key, so
+// nothing that worked before the reset still does, and lifts any login
+// lockout on the account.
+func (cfg *apiConfig) resetPassword(w http.ResponseWriter, req *http.Request) {
+	rb := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid request body", err)
+		return
+	}
+	if rb.Password == "" {
+		respondWithError(w, req, http.StatusBadRequest, "Password must not be empty", nil)
+		return
+	}
+
+	var user database.User
+	err := cfg.withTx(req.Context(), func(q *database.Queries) error {
+		userID, err := q.UsePasswordReset(req.Context(), database.UsePasswordResetParams{
+			Now:       time.Now().UTC(),
+			TokenHash: auth.HashRefreshToken(rb.Token),
+		})
+		if err != nil {
+			return err
+		}
+		hp, err := cfg.passwords.Hash(rb.Password)
+		if err != nil {
+			return err
+		}
+		user, err = q.SetUserPassword(req.Context(), database.SetUserPasswordParams{
+			ID:             userID,
+			HashedPassword: hp,
+		})
+		if err != nil {
+			return err
+		}
+		if err := q.RevokeUserSessions(req.Context(), userID); err != nil {
+			return err
+		}
+		if err := q.RevokeUserAPIKeys(req.Context(), userID); err != nil {
+			return err
+		}
+		return q.DeletePasswordResets(req.Context(), userID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid or expired reset token", err)
+		return
+	}
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		respondWithError(w, req, http.StatusBadRequest, "Password is too long", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error resetting password", err)
+		return
+	}
+	setRequestUserID(req.Context(), user.ID)
+	if err := cfg.db.ClearFailedLogins(req.Context(), user.Email); err != nil {
+		slog.ErrorContext(req.Context(), "error clearing failed logins", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "password reset")
+}
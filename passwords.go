@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+)
+
+// newPasswordHasher hashes new passwords with PASSWORD_HASH, "argon2id" (the
+// default) or "bcrypt", at the costs set by ARGON2_MEMORY_KIB,
+// ARGON2_ITERATIONS, ARGON2_PARALLELISM and BCRYPT_COST. Hashes made by
+// either are always accepted.
+func newPasswordHasher() (*auth.PasswordHasher, error) {
+	h := &auth.PasswordHasher{
+		Algorithm: envString("PASSWORD_HASH", auth.Argon2id),
+		Argon2id: auth.Argon2idParams{
+			Memory:      uint32(envInt("ARGON2_MEMORY_KIB", int(auth.DefaultArgon2idParams.Memory))),
+			Iterations:  uint32(envInt("ARGON2_ITERATIONS", int(auth.DefaultArgon2idParams.Iterations))),
+			Parallelism: uint8(envInt("ARGON2_PARALLELISM", int(auth.DefaultArgon2idParams.Parallelism))),
+			SaltLength:  auth.DefaultArgon2idParams.SaltLength,
+			KeyLength:   auth.DefaultArgon2idParams.KeyLength,
+		},
+		BcryptCost: envInt("BCRYPT_COST", auth.DefaultBcryptCost),
+	}
+	switch h.Algorithm {
+	case auth.Argon2id:
+		if h.Argon2id.Memory < 8*uint32(h.Argon2id.Parallelism) || h.Argon2id.Iterations == 0 || h.Argon2id.Parallelism == 0 {
+			return nil, fmt.Errorf("invalid argon2id parameters %+v", h.Argon2id)
+		}
+	case auth.Bcrypt:
+		if h.BcryptCost < 10 || h.BcryptCost > 31 {
+			return nil, fmt.Errorf("BCRYPT_COST must be between 10 and 31, got %d", h.BcryptCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_HASH %q", h.Algorithm)
+	}
+	return h, nil
+}
+
+// upgradePasswordHash rehashes a password that has just been checked if its
+// stored hash is outdated. It leaves the token version alone, since the
+// password itself hasn't changed, and gives up if the hash changed in the
+// meantime.
+func (cfg *apiConfig) upgradePasswordHash(ctx context.Context, user database.User, password string) {
+	if !cfg.passwords.NeedsRehash(user.HashedPassword) {
+		return
+	}
+	hash, err := cfg.passwords.Hash(password)
+	if err != nil {
+		slog.WarnContext(ctx, "error rehashing password", "error", err)
+		return
+	}
+	err = cfg.db.UpgradeUserPasswordHash(ctx, database.UpgradeUserPasswordHashParams{
+		NewHash: hash,
+		ID:      user.ID,
+		OldHash: user.HashedPassword,
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "error storing rehashed password", "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "password hash upgraded", "algorithm", cfg.passwords.Algorithm)
+}
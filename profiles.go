@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// Handles are unique regardless of case but keep the case they were chosen
+// with for display.
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// reservedHandles would be shadowed by, or confused with, fixed routes under
+// /api/users/.
+var reservedHandles = map[string]bool{
+	"admin":  true,
+	"export": true,
+	"me":     true,
+	"totp":   true,
+}
+
+// Author is the public face of a chirp's author, so clients can show who
+// wrote it without ever seeing an email address.
+type Author struct {
+	ID          uuid.UUID `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+}
+
+// Profile is a user as anyone can see them.
+type Profile struct {
+	ID          uuid.UUID `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	CreatedAt   time.Time `json:"created_at"`
+	ChirpCount  int64     `json:"chirp_count"`
+}
+
+// checkProfile returns why the given profile fields can't be saved, or ""
+// if they can. Nil fields are left as they are.
+func checkProfile(handle, displayName, bio *string) string {
+	if handle != nil {
+		if !handlePattern.MatchString(*handle) {
+			return "Handle must be 3 to 30 letters, digits or underscores"
+		}
+		if reservedHandles[strings.ToLower(*handle)] {
+			return "Handle is reserved"
+		}
+	}
+	if displayName != nil && utf8.RuneCountInString(*displayName) > maxDisplayNameLength {
+		return "Display name is too long"
+	}
+	if bio != nil && utf8.RuneCountInString(*bio) > maxBioLength {
+		return "Bio is too long"
+	}
+	return ""
+}
+
+// generateHandle picks a handle for users who sign up without choosing one.
+// They can change it later.
+func generateHandle() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "user_" + hex.EncodeToString(b), nil
+}
+
+func (cfg *apiConfig) getProfile(w http.ResponseWriter, req *http.Request) {
+	row, err := cfg.db.GetUserProfileByHandle(req.Context(), req.PathValue("handle"))
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, req, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, Profile(row))
+}
+
+// authorOf is the Author for chirps written by user.
+func authorOf(user database.User) Author {
+	return Author{ID: user.ID, Handle: user.Handle, DisplayName: user.DisplayName}
+}
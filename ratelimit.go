@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/0x4D5352/chirpy/internal/ratelimit"
+)
+
+const (
+	// Buckets idle this long are certainly full again and can be dropped.
+	rateLimitStaleAfter    = 24 * time.Hour
+	rateLimitPruneInterval = 10 * time.Minute
+)
+
+// pgRateLimitStore keeps token buckets in Postgres so every instance
+// enforces the same limits. Each Take locks its key's row for one short
+// transaction.
+type pgRateLimitStore struct {
+	withTx    func(ctx context.Context, fn func(q *database.Queries) error) error
+	db        *database.Queries
+	lastPrune atomic.Int64
+}
+
+func (s *pgRateLimitStore) Take(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (ratelimit.Result, error) {
+	var result ratelimit.Result
+	err := s.withTx(ctx, func(q *database.Queries) error {
+		err := q.CreateRateLimitBucket(ctx, database.CreateRateLimitBucketParams{
+			Key:       key,
+			Tokens:    float64(limit.Burst),
+			UpdatedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		row, err := q.GetRateLimitBucketForUpdate(ctx, key)
+		if err != nil {
+			return err
+		}
+		bucket := ratelimit.Bucket{Tokens: row.Tokens, Updated: row.UpdatedAt}
+		result = bucket.Take(limit, now)
+		return q.UpdateRateLimitBucket(ctx, database.UpdateRateLimitBucketParams{
+			Key:       key,
+			Tokens:    bucket.Tokens,
+			UpdatedAt: bucket.Updated,
+		})
+	})
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	s.prune(ctx, now)
+	return result, nil
+}
+
+// prune deletes stale buckets at most once per rateLimitPruneInterval.
+func (s *pgRateLimitStore) prune(ctx context.Context, now time.Time) {
+	last := s.lastPrune.Load()
+	if now.Unix()-last < int64(rateLimitPruneInterval.Seconds()) || !s.lastPrune.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	if err := s.db.DeleteRateLimitBucketsBefore(ctx, now.Add(-rateLimitStaleAfter)); err != nil {
+		slog.WarnContext(ctx, "error pruning rate limit buckets", "error", err)
+	}
+}
+
+// newRateLimitStore picks the store named by RATE_LIMIT_STORE: "memory"
+// (the default) for a single instance, or "postgres" to share limits.
+func (cfg *apiConfig) newRateLimitStore() (ratelimit.Store, error) {
+	switch store := envString("RATE_LIMIT_STORE", "memory"); store {
+	case "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "postgres":
+		return &pgRateLimitStore{withTx: cfg.withTx, db: cfg.db}, nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", store)
+	}
+}
+
+// envRateLimit reads a limit such as "20/1m" (20 requests per minute) from
+// the environment, falling back to the default when the variable is unset
+// or invalid.
+func envRateLimit(key string, fallback ratelimit.Limit) ratelimit.Limit {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	count, period, ok := strings.Cut(raw, "/")
+	n, err := strconv.Atoi(count)
+	if err != nil || !ok || n <= 0 {
+		slog.Warn("invalid rate limit in environment, using default", "key", key, "value", raw)
+		return fallback
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		slog.Warn("invalid rate limit in environment, using default", "key", key, "value", raw)
+		return fallback
+	}
+	return ratelimit.Per(n, d)
+}
+
+// rateLimitByIP counts requests against the client address.
+func (cfg *apiConfig) rateLimitByIP(req *http.Request) string {
+	return "ip:" + cfg.clientIP(req)
+}
+
+// rateLimitByUser counts requests with a valid access token against the
+// user, so users sharing an address don't share a limit, and the rest
+// against the client address. Handlers still authenticate the request
+// themselves.
+func (cfg *apiConfig) rateLimitByUser(req *http.Request) string {
+	if token, err := auth.GetAccessToken(req); err == nil {
+		if auth.IsAPIKey(token) {
+			if key, err := cfg.checkAPIKey(req.Context(), token); err == nil {
+				return "user:" + key.UserID.String()
+			}
+			return cfg.rateLimitByIP(req)
+		}
+		if claims, err := cfg.keys.ParseJWT(token, nil); err == nil {
+			return "user:" + claims.UserID.String()
+		}
+	}
+	return cfg.rateLimitByIP(req)
+}
+
+// middlewareRateLimit refuses requests with a 429 once key's bucket in l is
+// empty. If the store fails the request is let through: an outage of the
+// limiter should not become an outage of the API.
+func (cfg *apiConfig) middlewareRateLimit(l *ratelimit.Limiter, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			result, err := l.Allow(req.Context(), key(req))
+			if err != nil {
+				slog.ErrorContext(req.Context(), "rate limiter failed, allowing request", "limiter", l.Name(), "error", err)
+				next.ServeHTTP(w, req)
+				return
+			}
+			result.SetHeaders(w.Header())
+			if !result.Allowed {
+				cfg.metrics.rateLimited.Inc(l.Name())
+				respondWithError(w, req, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Per-request failures are reported through these helpers: they log the
+// cause, write a status code to the client and return, and never exit the
+// process. A failed write only means the client went away, so it is logged
+// and otherwise ignored.
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func respondWithError(w http.ResponseWriter, req *http.Request, code int, msg string, err error) {
+	if err != nil {
+		level := slog.LevelInfo
+		if code >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(req.Context(), level, msg, "status", code, "error", err)
+	}
+	respondWithJSON(w, code, errorResponse{Error: msg})
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload any) {
+	resp, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("error encoding response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(resp); err != nil {
+		slog.Debug("error writing response", "error", err)
+	}
+}
+
+func respondWithText(w http.ResponseWriter, code int, contentType, body string) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	if _, err := io.WriteString(w, body); err != nil {
+		slog.Debug("error writing response", "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/clientip"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxUserAgentLength = 512
+
+// clientInfo describes the device a session was started or refreshed from.
+type clientInfo struct {
+	userAgent string
+	ip        string
+}
+
+func (cfg *apiConfig) clientInfo(req *http.Request) clientInfo {
+	ua := req.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		// Cut on a rune boundary so the stored value stays valid UTF-8.
+		n := maxUserAgentLength
+		for n > 0 && !utf8.RuneStart(ua[n]) {
+			n--
+		}
+		ua = ua[:n]
+	}
+	return clientInfo{userAgent: ua, ip: cfg.clientIP(req)}
+}
+
+// newClientIPResolver reads the reverse proxies in front of chirpy from
+// TRUSTED_PROXIES, a comma-separated list of CIDRs or addresses. The older
+// TRUST_PROXY_HEADERS=true trusts loopback and private networks instead.
+func newClientIPResolver() (clientip.Resolver, error) {
+	if raw := os.Getenv("TRUSTED_PROXIES"); raw != "" {
+		trusted, err := clientip.ParseTrusted(raw)
+		if err != nil {
+			return clientip.Resolver{}, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+		}
+		return clientip.Resolver{Trusted: trusted}, nil
+	}
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		return clientip.Resolver{Trusted: clientip.PrivateNetworks}, nil
+	}
+	return clientip.Resolver{}, nil
+}
+
+// clientIP is the address of the caller. X-Forwarded-For entries are only
+// believed when they were added by a trusted proxy, since clients can put
+// anything in it.
+func (cfg *apiConfig) clientIP(req *http.Request) string {
+	return cfg.proxies.ClientIP(req)
+}
+
+// Session is one login, i.e. one refresh token family, as seen by its owner.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	StartedAt  time.Time `json:"started_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func sessionsFromRows(rows []database.ListSessionsRow) []Session {
+	sessions := make([]Session, 0, len(rows))
+	for _, row := range rows {
+		sessions = append(sessions, Session{
+			ID:         row.FamilyID,
+			UserAgent:  row.UserAgent,
+			IPAddress:  row.IpAddress,
+			StartedAt:  row.StartedAt,
+			LastUsedAt: row.LastUsedAt,
+			ExpiresAt:  row.ExpiresAt,
+		})
+	}
+	return sessions
+}
+
+func (cfg *apiConfig) listSessions(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := cfg.db.ListSessions(req.Context(), database.ListSessionsParams{
+		UserID: claims.UserID,
+		Now:    time.Now().UTC(),
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error listing sessions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sessionsFromRows(rows))
+}
+
+func (cfg *apiConfig) revokeSession(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	sessionID, err := uuid.Parse(req.PathValue("id"))
+	if err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid session id", nil)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeSession(req.Context(), database.RevokeSessionParams{
+		UserID:   claims.UserID,
+		FamilyID: sessionID,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error revoking session", err)
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, req, http.StatusNotFound, "Session not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "session revoked", "session_id", sessionID)
+}
+
+// revokeOtherSessions logs the caller out everywhere except the session the
+// presented refresh token belongs to. Like /api/refresh and /api/revoke it
+// takes the refresh token as the bearer token or refresh token cookie.
+func (cfg *apiConfig) revokeOtherSessions(w http.ResponseWriter, req *http.Request) {
+	bearerToken, err := refreshTokenFromRequest(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "missing refresh token", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	refreshToken, err := cfg.db.GetRefreshToken(req.Context(), auth.HashRefreshToken(bearerToken))
+	if err != nil || refreshToken.RevokedAt.Valid || refreshToken.RotatedAt.Valid || time.Until(refreshToken.ExpiresAt) <= 0 {
+		slog.InfoContext(req.Context(), "refresh token not usable for revoking other sessions", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	setRequestUserID(req.Context(), refreshToken.UserID)
+
+	err = cfg.db.RevokeOtherSessions(req.Context(), database.RevokeOtherSessionsParams{
+		UserID:   refreshToken.UserID,
+		FamilyID: refreshToken.FamilyID,
+	})
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error revoking sessions", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "other sessions revoked", "session_id", refreshToken.FamilyID)
+}
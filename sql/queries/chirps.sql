@@ -10,12 +10,21 @@ VALUES (
 RETURNING *;
 
 -- name: GetChirp :one
-SELECT * FROM chirps
-WHERE id = $1;
+SELECT chirps.*, users.handle AS author_handle, users.display_name AS author_display_name
+FROM chirps
+JOIN users ON users.id = chirps.user_id
+WHERE chirps.id = $1;
 
 -- name: GetChirps :many
-SELECT * FROM chirps
-ORDER BY created_at ASC;
+SELECT chirps.*, users.handle AS author_handle, users.display_name AS author_display_name
+FROM chirps
+JOIN users ON users.id = chirps.user_id
+ORDER BY chirps.created_at ASC;
 
 -- name: ResetChirps :exec
 DELETE FROM chirps;
+
+-- name: GetChirpsByUser :many
+SELECT * FROM chirps
+WHERE user_id = $1
+ORDER BY created_at ASC;
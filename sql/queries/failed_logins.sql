@@ -0,0 +1,34 @@
+-- name: RecordFailedLogin :one
+INSERT INTO failed_logins (user_id, email, ip_address, attempted_at)
+VALUES (
+	$1,
+	$2,
+	$3,
+	$4
+)
+RETURNING id;
+
+-- name: GetFailedLoginsByEmail :one
+SELECT COUNT(*)::INTEGER AS failures, COALESCE(MAX(attempted_at), 'epoch')::TIMESTAMP AS last_failure
+FROM failed_logins
+WHERE email = @email AND attempted_at > @since AND id <> @attempt_id;
+
+-- name: GetFailedLoginsByIP :one
+SELECT COUNT(*)::INTEGER AS failures, COALESCE(MAX(attempted_at), 'epoch')::TIMESTAMP AS last_failure
+FROM failed_logins
+WHERE ip_address = @ip_address AND attempted_at > @since AND id <> @attempt_id;
+
+-- name: ClearFailedLogins :exec
+DELETE FROM failed_logins
+WHERE email = $1;
+
+-- name: DeleteFailedLogin :exec
+DELETE FROM failed_logins
+WHERE id = $1;
+
+-- name: DeleteFailedLoginsBefore :exec
+DELETE FROM failed_logins
+WHERE attempted_at < $1;
+
+-- name: ResetFailedLogins :exec
+DELETE FROM failed_logins;
@@ -0,0 +1,18 @@
+-- name: InsertPageHits :exec
+INSERT INTO page_hits (path, hit_at)
+SELECT unnest(@paths::text[]), unnest(@hit_ats::timestamp[]);
+
+-- name: GetPageHitTotals :many
+SELECT path, COUNT(*) AS hits FROM page_hits
+GROUP BY path
+ORDER BY hits DESC, path ASC;
+
+-- name: GetDailyPageHits :many
+SELECT path, date_trunc('day', hit_at)::date AS day, COUNT(*) AS hits
+FROM page_hits
+WHERE hit_at >= @since
+GROUP BY path, day
+ORDER BY day ASC, path ASC;
+
+-- name: ResetPageHits :exec
+DELETE FROM page_hits;
@@ -0,0 +1,13 @@
+-- name: CreatePasswordReset :exec
+INSERT INTO password_resets (token_hash, user_id, created_at, expires_at)
+VALUES ($1, $2, NOW(), $3);
+
+-- name: UsePasswordReset :one
+UPDATE password_resets
+SET used_at = @now::TIMESTAMP
+WHERE token_hash = @token_hash AND used_at IS NULL AND expires_at > @now::TIMESTAMP
+RETURNING user_id;
+
+-- name: DeletePasswordResets :exec
+DELETE FROM password_resets
+WHERE user_id = $1;
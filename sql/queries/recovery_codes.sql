@@ -0,0 +1,12 @@
+-- name: CreateRecoveryCodes :exec
+INSERT INTO recovery_codes (code_hash, user_id, created_at)
+SELECT unnest(@code_hashes::text[]), @user_id::uuid, NOW();
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes
+WHERE user_id = $1;
@@ -1,26 +1,78 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, family_id, user_agent, ip_address, last_used_at, client_id, scope)
 VALUES (
 	$1,
 	NOW(),
 	NOW(),
 	$2,
-	CURRENT_DATE + 60
+	$3,
+	$4,
+	$5,
+	$6,
+	NOW(),
+	$7,
+	$8
 )
 RETURNING *;
 
+-- name: DeleteStaleRefreshTokens :execrows
+DELETE FROM refresh_tokens r
+WHERE r.expires_at <= @now::TIMESTAMP
+	OR (
+		r.rotated_at < @rotated_before::TIMESTAMP
+		AND r.created_at > (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = r.family_id)
+	);
+
 -- name: GetRefreshToken :one
 SELECT * FROM refresh_tokens
-WHERE token = $1;
+WHERE token_hash = $1;
 
 -- name: GetRefreshTokens :many
 SELECT * FROM refresh_tokens
 ORDER BY created_at ASC;
 
+-- name: RotateRefreshToken :one
+UPDATE refresh_tokens
+SET rotated_at = NOW(), updated_at = NOW(), last_used_at = NOW()
+WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL
+RETURNING *;
+
+-- name: ListSessions :many
+SELECT
+	family_id,
+	user_agent,
+	ip_address,
+	(SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = refresh_tokens.family_id)::timestamp AS started_at,
+	last_used_at,
+	expires_at
+FROM refresh_tokens
+WHERE user_id = @user_id AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > @now::TIMESTAMP
+ORDER BY last_used_at DESC;
+
 -- name: RevokeToken :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1;
+WHERE token_hash = $1;
+
+-- name: RevokeTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL;
+
+-- name: RevokeSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND family_id = $2 AND revoked_at IS NULL;
+
+-- name: RevokeOtherSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL;
+
+-- name: RevokeUserSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
 
 -- name: ResetTokens :exec
 DELETE FROM refresh_tokens;
@@ -1,11 +1,13 @@
 -- name: CreateUser :one
-INSERT INTO users (id, created_at, updated_at, email, hashed_password)
+INSERT INTO users (id, created_at, updated_at, email, hashed_password, handle, display_name)
 VALUES (
 	gen_random_uuid(),
 	NOW(),
 	NOW(),
 	$1,
-	$2
+	$2,
+	$3,
+	$4
 )
 RETURNING *;
 
@@ -17,10 +19,97 @@ WHERE id = $1;
 SELECT * FROM users
 WHERE email = $1;
 
--- name: UpdateUser :exec
+-- name: GetUserTokenVersion :one
+SELECT token_version FROM users
+WHERE id = $1;
+
+-- name: UpdateUser :one
+UPDATE users
+SET email = $1, hashed_password = $2, updated_at = NOW(), token_version = token_version + 1,
+	email_verified_at = CASE WHEN email = $1 THEN email_verified_at END
+WHERE id = $3
+RETURNING *;
+
+-- name: SetUserPassword :one
+UPDATE users
+SET hashed_password = $2, updated_at = NOW(), token_version = token_version + 1
+WHERE id = $1
+RETURNING *;
+
+-- name: UpgradeUserPasswordHash :exec
+UPDATE users
+SET hashed_password = @new_hash
+WHERE id = @id AND hashed_password = @old_hash;
+
+-- name: VerifyUserEmail :execrows
 UPDATE users
-SET email = $1, hashed_password = $2, updated_at = NOW()
-WHERE id = $3;
+SET email_verified_at = NOW(), updated_at = NOW()
+WHERE id = $1 AND email_verified_at IS NULL;
+
+-- name: SetUserTOTPSecret :exec
+UPDATE users
+SET totp_secret = $2, totp_enabled = FALSE, updated_at = NOW()
+WHERE id = $1;
+
+-- name: EnableUserTOTP :exec
+UPDATE users
+SET totp_enabled = TRUE, totp_last_step = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: DisableUserTOTP :exec
+UPDATE users
+SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0, updated_at = NOW()
+WHERE id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE users
+SET totp_last_step = $2
+WHERE id = $1 AND totp_last_step < $2;
 
 -- name: ResetUsers :exec
 DELETE FROM users;
+
+-- name: ScheduleUserDeletion :one
+UPDATE users
+SET delete_after = $2, updated_at = NOW(), token_version = token_version + 1
+WHERE id = $1
+RETURNING *;
+
+-- name: CancelUserDeletion :exec
+UPDATE users
+SET delete_after = NULL, updated_at = NOW()
+WHERE id = $1;
+
+-- name: DeleteUser :exec
+DELETE FROM users
+WHERE id = $1;
+
+-- name: PurgeDeletedUsers :execrows
+DELETE FROM users
+WHERE delete_after <= @now::TIMESTAMP;
+
+-- name: UpdateUserProfile :one
+UPDATE users
+SET handle = $2, display_name = $3, bio = $4, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: GetUserProfileByHandle :one
+SELECT
+	id,
+	handle,
+	display_name,
+	bio,
+	created_at,
+	(SELECT COUNT(*) FROM chirps WHERE chirps.user_id = users.id) AS chirp_count
+FROM users
+WHERE LOWER(handle) = LOWER(@handle);
+
+-- name: GetUserRole :one
+SELECT role FROM users
+WHERE id = $1;
+
+-- name: SetUserRoleByEmail :execrows
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE email = $1;
@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE page_hits (
+	id BIGSERIAL PRIMARY KEY,
+	path TEXT NOT NULL,
+	hit_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX page_hits_hit_at_idx ON page_hits (hit_at);
+
+-- +goose Down
+DROP TABLE page_hits;
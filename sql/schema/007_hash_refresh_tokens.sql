@@ -0,0 +1,15 @@
+-- +goose Up
+-- Refresh tokens are now stored as the hex SHA-256 of the token handed to
+-- the client. Existing rows are re-hashed in place so sessions survive.
+ALTER TABLE refresh_tokens
+RENAME COLUMN token TO token_hash;
+
+UPDATE refresh_tokens
+SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+
+-- +goose Down
+-- Hashes cannot be turned back into tokens, so every session is dropped.
+DELETE FROM refresh_tokens;
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN token_hash TO token;
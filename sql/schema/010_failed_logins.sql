@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE failed_logins (
+	id BIGSERIAL PRIMARY KEY,
+	user_id UUID REFERENCES users (id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	ip_address TEXT NOT NULL,
+	attempted_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX failed_logins_email_idx ON failed_logins (email, attempted_at);
+CREATE INDEX failed_logins_ip_address_idx ON failed_logins (ip_address, attempted_at);
+CREATE INDEX failed_logins_attempted_at_idx ON failed_logins (attempted_at);
+
+-- +goose Down
+DROP TABLE failed_logins;
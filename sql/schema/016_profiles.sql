@@ -0,0 +1,21 @@
+-- +goose Up
+ALTER TABLE users
+ADD COLUMN handle TEXT,
+ADD COLUMN display_name TEXT NOT NULL DEFAULT '',
+ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+
+UPDATE users
+SET handle = 'user_' || LEFT(REPLACE(id::text, '-', ''), 12);
+
+ALTER TABLE users
+ALTER COLUMN handle SET NOT NULL;
+
+CREATE UNIQUE INDEX users_handle_key ON users (LOWER(handle));
+
+-- +goose Down
+DROP INDEX users_handle_key;
+
+ALTER TABLE users
+DROP COLUMN bio,
+DROP COLUMN display_name,
+DROP COLUMN handle;
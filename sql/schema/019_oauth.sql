@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE oauth_clients (
+	id TEXT PRIMARY KEY,
+	owner_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	-- NULL for public clients, which can't keep a secret.
+	secret_hash TEXT,
+	redirect_uris TEXT[] NOT NULL,
+	scopes TEXT[] NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX oauth_clients_owner_id_idx ON oauth_clients (owner_id);
+
+CREATE TABLE oauth_authorization_codes (
+	code_hash TEXT PRIMARY KEY,
+	client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	redirect_uri TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	code_challenge TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
+
+ALTER TABLE refresh_tokens
+	ADD COLUMN client_id TEXT REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE refresh_tokens
+	DROP COLUMN scope,
+	DROP COLUMN client_id;
+
+DROP TABLE oauth_authorization_codes;
+
+DROP TABLE oauth_clients;
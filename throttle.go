@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// loginThrottle slows down password guessing against a single account and
+// password spraying from a single address. Failures are kept in
+// failed_logins for window; a successful login or an admin unlock clears
+// an account's failures.
+type loginThrottle struct {
+	account auth.LoginPolicy
+	ip      auth.LoginPolicy
+	window  time.Duration
+}
+
+func newLoginThrottle() loginThrottle {
+	lockout := envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	return loginThrottle{
+		account: auth.LoginPolicy{
+			FreeAttempts:     3,
+			BaseDelay:        time.Second,
+			MaxDelay:         lockout,
+			LockoutThreshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+			LockoutDuration:  lockout,
+		},
+		// One address may be shared by many users, so it gets more
+		// attempts and is only ever slowed down, never locked.
+		ip: auth.LoginPolicy{
+			FreeAttempts: envInt("LOGIN_IP_FREE_ATTEMPTS", 20),
+			BaseDelay:    time.Second,
+			MaxDelay:     lockout,
+		},
+		window: envDuration("LOGIN_FAILURE_WINDOW", time.Hour),
+	}
+}
+
+// beginLoginAttempt counts an attempt to log in as email from ip before the
+// credentials are checked, and returns the attempt's ID along with how long
+// the client has to wait first. userID is uuid.Nil when the email is
+// unknown.
+//
+// The attempt is stored, and committed, before the earlier ones are
+// counted, so parallel requests each see at least every attempt that
+// started before them and can't all get through on the same count. It
+// stands as a failure unless loginAttemptSucceeded forgets it. An attempt
+// that has to wait never gets to the credentials check, so it is forgotten
+// straight away and doesn't push the wait further out.
+func (cfg *apiConfig) beginLoginAttempt(ctx context.Context, email string, userID uuid.UUID, ip string) (int64, time.Duration, error) {
+	id, err := cfg.db.RecordFailedLogin(ctx, database.RecordFailedLoginParams{
+		UserID:      uuid.NullUUID{UUID: userID, Valid: userID != uuid.Nil},
+		Email:       email,
+		IpAddress:   ip,
+		AttemptedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	wait, err := cfg.loginRetryAfter(ctx, email, ip, id)
+	if err != nil || wait > 0 {
+		cfg.loginAttemptSucceeded(ctx, id)
+		return 0, wait, err
+	}
+	return id, 0, nil
+}
+
+// loginRetryAfter returns how long the attempt with the given ID has to wait
+// because of the attempts around it, and drops those too old to count any
+// more.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, email, ip string, attemptID int64) (time.Duration, error) {
+	now := time.Now().UTC()
+	since := now.Add(-cfg.loginThrottle.window)
+	if err := cfg.db.DeleteFailedLoginsBefore(ctx, since); err != nil {
+		return 0, err
+	}
+	account, err := cfg.db.GetFailedLoginsByEmail(ctx, database.GetFailedLoginsByEmailParams{
+		Email:     email,
+		Since:     since,
+		AttemptID: attemptID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := cfg.db.GetFailedLoginsByIP(ctx, database.GetFailedLoginsByIPParams{
+		IpAddress: ip,
+		Since:     since,
+		AttemptID: attemptID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return max(
+		cfg.loginThrottle.account.RetryAfter(int(account.Failures), account.LastFailure, now),
+		cfg.loginThrottle.ip.RetryAfter(int(byIP.Failures), byIP.LastFailure, now),
+	), nil
+}
+
+// loginAttemptSucceeded forgets an attempt from beginLoginAttempt whose
+// credentials turned out to be right.
+func (cfg *apiConfig) loginAttemptSucceeded(ctx context.Context, attemptID int64) {
+	if err := cfg.db.DeleteFailedLogin(ctx, attemptID); err != nil {
+		slog.ErrorContext(ctx, "error forgetting login attempt", "error", err)
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounding up
+// so clients never retry too early.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const accessTokenTTL = time.Hour
+
+var (
+	errRefreshTokenUnknown = errors.New("unknown refresh token")
+	errRefreshTokenClient  = errors.New("refresh token belongs to another client")
+	errRefreshTokenReused  = errors.New("refresh token already rotated")
+	errRefreshTokenRevoked = errors.New("refresh token revoked")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+func (cfg *apiConfig) makeAccessToken(claims auth.Claims) (string, error) {
+	return cfg.keys.MakeSessionJWT(claims, accessTokenTTL)
+}
+
+// loadKeySet signs with the PEM key in JWT_SIGNING_KEY_FILE when set, also
+// accepting tokens from the comma-separated JWT_VERIFY_KEY_FILES (e.g. the
+// key being rotated out). Without it, tokens fall back to HS256 with SECRET.
+// Tokens are issued for JWT_AUDIENCE and checked with JWT_LEEWAY of clock
+// skew.
+func loadKeySet(secret string) (*auth.KeySet, error) {
+	validation := auth.Validation{
+		Audience: envString("JWT_AUDIENCE", "chirpy"),
+		Leeway:   envDuration("JWT_LEEWAY", 30*time.Second),
+	}
+	signingKeyFile := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if signingKeyFile == "" {
+		slog.Warn("JWT_SIGNING_KEY_FILE not set, signing access tokens with HS256")
+		return auth.NewHMACKeySet(secret).WithValidation(validation), nil
+	}
+	var verifyKeyFiles []string
+	for _, file := range strings.Split(os.Getenv("JWT_VERIFY_KEY_FILES"), ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			verifyKeyFiles = append(verifyKeyFiles, file)
+		}
+	}
+	keys, err := auth.LoadKeySet(signingKeyFile, verifyKeyFiles...)
+	if err != nil {
+		return nil, err
+	}
+	return keys.WithValidation(validation), nil
+}
+
+// getJWKS publishes the public keys other services use to verify our access
+// tokens.
+func (cfg *apiConfig) getJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.keys.JWKS())
+}
+
+// authenticate validates the access token in the Authorization header or
+// access token cookie, including that it has not been invalidated by a
+// credential change. API keys and tokens issued to OAuth clients are
+// refused.
+func (cfg *apiConfig) authenticate(req *http.Request) (auth.Claims, error) {
+	return cfg.authenticateScoped(req, "")
+}
+
+// authenticateScoped is authenticate that also accepts an API key or OAuth
+// client token granted scope. Claims from an API key have no session.
+func (cfg *apiConfig) authenticateScoped(req *http.Request, scope string) (auth.Claims, error) {
+	bearerToken, err := auth.GetAccessToken(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "missing access token", "error", err)
+		return auth.Claims{}, err
+	}
+	if auth.IsAPIKey(bearerToken) {
+		claims, err := cfg.authenticateAPIKey(req.Context(), bearerToken, scope)
+		if err != nil {
+			slog.InfoContext(req.Context(), "API key rejected", "scope", scope, "error", err)
+			return auth.Claims{}, err
+		}
+		return claims, nil
+	}
+	currentVersion := func(userID uuid.UUID) (int32, error) {
+		return cfg.db.GetUserTokenVersion(req.Context(), userID)
+	}
+	claims, err := cfg.keys.ParseJWT(bearerToken, currentVersion)
+	if err != nil {
+		slog.InfoContext(req.Context(), "invalid access token", "error", err)
+		return auth.Claims{}, err
+	}
+	if claims.Scope != "" && (scope == "" || !auth.HasScope(claims.Scope, scope)) {
+		slog.InfoContext(req.Context(), "OAuth token rejected", "scope", scope, "error", errMissingScope)
+		return auth.Claims{}, errMissingScope
+	}
+	setRequestUserID(req.Context(), claims.UserID)
+	return claims, nil
+}
+
+// refreshFamily is the login a refresh token belongs to. Families started
+// by an OAuth client record the client and the scope it was granted, so
+// their tokens can only be refreshed by that client and never widen. Every
+// token in a family expires when the family does.
+type refreshFamily struct {
+	userID    uuid.UUID
+	id        uuid.UUID
+	clientID  sql.NullString
+	scope     string
+	expiresAt time.Time
+}
+
+func familyOf(token database.RefreshToken) refreshFamily {
+	return refreshFamily{
+		userID:    token.UserID,
+		id:        token.FamilyID,
+		clientID:  token.ClientID,
+		scope:     token.Scope,
+		expiresAt: token.ExpiresAt,
+	}
+}
+
+// issueRefreshToken stores a new refresh token in the given family and
+// returns the raw token for the client; only its hash is kept. Use
+// uuid.New() as the family ID and leave expiresAt zero to start a new
+// family, i.e. a new login.
+func issueRefreshToken(ctx context.Context, q *database.Queries, family refreshFamily, client clientInfo) (string, error) {
+	rawRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := family.expiresAt
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().UTC().Add(refreshTokenTTL)
+	}
+	_, err = q.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+		TokenHash: auth.HashRefreshToken(rawRefreshToken),
+		UserID:    family.userID,
+		ExpiresAt: expiresAt,
+		FamilyID:  family.id,
+		UserAgent: client.userAgent,
+		IpAddress: client.ip,
+		ClientID:  family.clientID,
+		Scope:     family.scope,
+	})
+	if err != nil {
+		return "", err
+	}
+	return rawRefreshToken, nil
+}
+
+// rotateRefreshToken swaps a refresh token for the next one in its family
+// and returns the old token's row along with the new raw token. Each
+// refresh token can be used once; presenting one that has already been
+// rotated means it was copied, so every token descended from the same login
+// is revoked. clientID must be the OAuth client the family was started by,
+// or empty for a user's own logins.
+func (cfg *apiConfig) rotateRefreshToken(ctx context.Context, raw, clientID string, client clientInfo) (database.RefreshToken, string, error) {
+	refreshToken, err := cfg.db.GetRefreshToken(ctx, auth.HashRefreshToken(raw))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.RefreshToken{}, "", errRefreshTokenUnknown
+	}
+	if err != nil {
+		return database.RefreshToken{}, "", err
+	}
+	setRequestUserID(ctx, refreshToken.UserID)
+	if refreshToken.ClientID.String != clientID {
+		return refreshToken, "", errRefreshTokenClient
+	}
+	if refreshToken.RotatedAt.Valid {
+		cfg.revokeReusedFamily(ctx, refreshToken)
+		return refreshToken, "", errRefreshTokenReused
+	}
+	if refreshToken.RevokedAt.Valid {
+		return refreshToken, "", errRefreshTokenRevoked
+	}
+	if time.Until(refreshToken.ExpiresAt) <= 0 {
+		return refreshToken, "", errRefreshTokenExpired
+	}
+
+	var next string
+	err = cfg.withTx(ctx, func(q *database.Queries) error {
+		// The conditional update only matches an unused token, so of two
+		// concurrent refreshes with the same token only one can win.
+		_, err := q.RotateRefreshToken(ctx, refreshToken.TokenHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errRefreshTokenReused
+		}
+		if err != nil {
+			return err
+		}
+		next, err = issueRefreshToken(ctx, q, familyOf(refreshToken), client)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		cfg.revokeReusedFamily(ctx, refreshToken)
+	}
+	return refreshToken, next, err
+}
+
+// isRefreshTokenError reports whether err from rotateRefreshToken is the
+// token's fault rather than the server's.
+func isRefreshTokenError(err error) bool {
+	return errors.Is(err, errRefreshTokenUnknown) ||
+		errors.Is(err, errRefreshTokenClient) ||
+		errors.Is(err, errRefreshTokenReused) ||
+		errors.Is(err, errRefreshTokenRevoked) ||
+		errors.Is(err, errRefreshTokenExpired)
+}
+
+// refreshUserToken exchanges a refresh token for a new access token and a new
+// refresh token. Tokens issued to OAuth clients are refreshed at the OAuth
+// token endpoint instead.
+func (cfg *apiConfig) refreshUserToken(w http.ResponseWriter, req *http.Request) {
+	bearerToken, err := refreshTokenFromRequest(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "missing refresh token", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	refreshToken, next, err := cfg.rotateRefreshToken(req.Context(), bearerToken, "", cfg.clientInfo(req))
+	if isRefreshTokenError(err) {
+		cfg.metrics.tokenRefreshes.Inc(resultFailure)
+		slog.InfoContext(req.Context(), "refresh failed", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		cfg.metrics.tokenRefreshes.Inc(resultFailure)
+		respondWithError(w, req, http.StatusInternalServerError, "Error rotating refresh token", err)
+		return
+	}
+
+	tokenVersion, err := cfg.db.GetUserTokenVersion(req.Context(), refreshToken.UserID)
+	if err != nil {
+		cfg.metrics.tokenRefreshes.Inc(resultFailure)
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	token, err := cfg.makeAccessToken(auth.Claims{
+		UserID:       refreshToken.UserID,
+		SessionID:    refreshToken.FamilyID,
+		TokenVersion: tokenVersion,
+	})
+	if err != nil {
+		cfg.metrics.tokenRefreshes.Inc(resultFailure)
+		respondWithError(w, req, http.StatusInternalServerError, "Error creating JWT", err)
+		return
+	}
+	respondWithRefreshedTokens(w, req, token, next)
+	cfg.metrics.tokenRefreshes.Inc(resultSuccess)
+	slog.InfoContext(req.Context(), "access token refreshed")
+}
+
+// respondWithRefreshedTokens hands out a rotated token pair the same way
+// the old one was presented: as cookies for a cookie session, or in the
+// response body otherwise.
+func respondWithRefreshedTokens(w http.ResponseWriter, req *http.Request, token, refreshToken string) {
+	if usesCookieSession(req) {
+		setAccessTokenCookie(w, token)
+		setRefreshTokenCookie(w, refreshToken)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{
+		Token:        token,
+		RefreshToken: refreshToken,
+	})
+}
+
+func (cfg *apiConfig) revokeReusedFamily(ctx context.Context, refreshToken database.RefreshToken) {
+	slog.WarnContext(ctx, "refresh token reuse detected, revoking token family",
+		"user_id", refreshToken.UserID,
+		"family_id", refreshToken.FamilyID,
+	)
+	if err := cfg.db.RevokeTokenFamily(ctx, refreshToken.FamilyID); err != nil {
+		slog.ErrorContext(ctx, "error revoking token family", "family_id", refreshToken.FamilyID, "error", err)
+	}
+}
+
+func (cfg *apiConfig) revokeUserToken(w http.ResponseWriter, req *http.Request) {
+	bearerToken, err := refreshTokenFromRequest(req)
+	if err != nil {
+		slog.InfoContext(req.Context(), "missing refresh token", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err = cfg.db.RevokeToken(req.Context(), auth.HashRefreshToken(bearerToken))
+	if err != nil {
+		slog.WarnContext(req.Context(), "failed to revoke token", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if usesCookieSession(req) {
+		clearSessionCookies(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.InfoContext(req.Context(), "refresh token revoked")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/0x4D5352/chirpy/internal/auth"
+	"github.com/0x4D5352/chirpy/internal/database"
+	"github.com/0x4D5352/chirpy/internal/mail"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	mailSendTimeout      = 10 * time.Second
+)
+
+// newMailer picks the Mailer named by MAILER: "smtp" to deliver through
+// SMTP_ADDR (with SMTP_USERNAME and SMTP_PASSWORD if set), "file" to write
+// messages to MAIL_DIR, or "log", the default, to only log their recipient
+// and subject.
+func newMailer() (mail.Mailer, error) {
+	from := envString("MAIL_FROM", "Chirpy <noreply@localhost>")
+	switch mailer := envString("MAILER", "log"); mailer {
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("MAILER=smtp needs SMTP_ADDR")
+		}
+		m := &mail.SMTPMailer{Addr: addr, From: from}
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			m.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return m, nil
+	case "file":
+		return &mail.FileMailer{Dir: envString("MAIL_DIR", "mail"), From: from}, nil
+	case "log":
+		slog.Warn("MAILER not set, emails will only be logged")
+		return &mail.LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", mailer)
+	}
+}
+
+// sendVerificationEmail mails the user a link that confirms they own their
+// address.
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.keys.MakeEmailVerification(auth.Claims{
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+	}, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	link := cfg.baseURL + "/api/users/verify-email?token=" + url.QueryEscape(token)
+	ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+	defer cancel()
+	return cfg.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your Chirpy email address",
+		Body: fmt.Sprintf("Confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't sign up for Chirpy, you can ignore this email.\n",
+			link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// verifyEmail is where verification links lead. Following a link twice is
+// harmless.
+func (cfg *apiConfig) verifyEmail(w http.ResponseWriter, req *http.Request) {
+	currentVersion := func(userID uuid.UUID) (int32, error) {
+		return cfg.db.GetUserTokenVersion(req.Context(), userID)
+	}
+	claims, err := cfg.keys.ParseEmailVerification(req.URL.Query().Get("token"), currentVersion)
+	if err != nil {
+		respondWithError(w, req, http.StatusBadRequest, "Invalid or expired verification link", err)
+		return
+	}
+	setRequestUserID(req.Context(), claims.UserID)
+	n, err := cfg.db.VerifyUserEmail(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error verifying email", err)
+		return
+	}
+	if n == 1 {
+		slog.InfoContext(req.Context(), "email address verified")
+	}
+	respondWithText(w, http.StatusOK, "text/plain; charset=utf-8", "Email address verified.")
+}
+
+func (cfg *apiConfig) resendVerificationEmail(w http.ResponseWriter, req *http.Request) {
+	claims, err := cfg.authenticate(req)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user, err := cfg.db.FindUserByID(req.Context(), claims.UserID)
+	if err != nil {
+		respondWithError(w, req, http.StatusInternalServerError, "Error finding user", err)
+		return
+	}
+	if user.EmailVerifiedAt.Valid {
+		respondWithError(w, req, http.StatusConflict, "Email address is already verified", nil)
+		return
+	}
+	if err := cfg.sendVerificationEmail(req.Context(), user); err != nil {
+		respondWithError(w, req, http.StatusBadGateway, "Error sending verification email", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}